@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -8,20 +9,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"text/template"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -45,6 +47,7 @@ type Cfg struct {
 	MaxVideosPerHour          int    `yaml:"MaxVideosPerHour"`
 	VideoPerPage              int    `yaml:"VideoPerPage"`
 	MaxVideoNameLen           int    `yaml:"MaxVideoNameLen"`
+	MaxTitleLen               int    `yaml:"MaxTitleLen"`
 	VideoResLow               string `yaml:"VideoResLow"`
 	VideoResMed               string `yaml:"VideoResMed"`
 	VideoResHigh              string `yaml:"VideoResHigh"`
@@ -59,35 +62,94 @@ type Cfg struct {
 	NrOfCoreVideoConv         string `yaml:"NrOfCoreVideoConv"`
 	VideoConvPreset           string `yaml:"VideoConvPreset"`
 	AllowUploadOnlyFromAdmins bool   `yaml:"AllowUploadOnlyFromAdmins"`
+	EnableLive                bool   `yaml:"EnableLive"`
+	LiveArchive               bool   `yaml:"LiveArchive"`
+	LiveSegDuration           string `yaml:"LiveSegDuration"`
+	LiveWindowSize            int    `yaml:"LiveWindowSize"`
+	ArchiveOriginals          bool   `yaml:"ArchiveOriginals"`
+	ArchivePath               string `yaml:"ArchivePath"`
+	ArchiveDaysOld            int    `yaml:"ArchiveDaysOld"`
+	ArchiveCompress           bool   `yaml:"ArchiveCompress"`
+	AllowOriginalDownload     bool   `yaml:"AllowOriginalDownload"`
+	ConvWorkers               int    `yaml:"ConvWorkers"`
+	ConvWindows               string `yaml:"ConvWindows"`
+	ConvOffPeakWorkers        int    `yaml:"ConvOffPeakWorkers"`
+	ConvBypassSize            int64  `yaml:"ConvBypassSize"`
+	ConvPriorityRole          string `yaml:"ConvPriorityRole"`
+	ConvTimeoutBase           string `yaml:"ConvTimeoutBase"`
+	ConvTimeoutFactor         int    `yaml:"ConvTimeoutFactor"`
+	ConvNice                  int    `yaml:"ConvNice"`
+	ConvIOClass               string `yaml:"ConvIOClass"`
+	ConvMemLimitMB            int    `yaml:"ConvMemLimitMB"`
+	EnableSceneChapters       bool   `yaml:"EnableSceneChapters"`
+	SceneThreshold            string `yaml:"SceneThreshold"`
+	SceneMinGap               int    `yaml:"SceneMinGap"`
+	SceneMaxChapters          int    `yaml:"SceneMaxChapters"`
+	TusExpiration             string `yaml:"TusExpiration"`
+	AllowPrivateVideos        bool   `yaml:"AllowPrivateVideos"`
+	KeyPath                   string `yaml:"KeyPath"`
+	WatchFolder               string `yaml:"WatchFolder"`
+	WatchInterval             int    `yaml:"WatchInterval"`
+	WatchUploader             string `yaml:"WatchUploader"`
+	EnableURLImport           bool   `yaml:"EnableURLImport"`
+	ImportAllowHosts          string `yaml:"ImportAllowHosts"`
+	ImportDenyHosts           string `yaml:"ImportDenyHosts"`
+	ImportAllowPrivate        bool   `yaml:"ImportAllowPrivate"`
+	ImportRetries             int    `yaml:"ImportRetries"`
+	TrustedProxies            string `yaml:"TrustedProxies"`
+	Scanner                   string `yaml:"Scanner"`
+	ClamdAddress              string `yaml:"ClamdAddress"`
+	ScanCommand               string `yaml:"ScanCommand"`
+	QuarantinePath            string `yaml:"QuarantinePath"`
+	DatabasePath              string `yaml:"DatabasePath"`
+	// Per role (admin, user, guest) limits, edited only in config.yaml
+	UploadPolicies map[string]UploadPolicy `yaml:"UploadPolicies"`
+	RoleQuotas     map[string]UploadQuota  `yaml:"RoleQuotas"`
+	// Per user quotas, overriding the quota of the role
+	UserQuotas map[string]UploadQuota `yaml:"UserQuotas"`
+	// Per route group (login, upload, api, media) rate limits
+	RateLimits map[string]RateLimit `yaml:"RateLimits"`
+	// Categories of the Video List, by URL key
+	Categories map[string]Category `yaml:"Categories"`
 }
 
 type folderInfo struct {
-	Name    string
-	ModTime time.Time
+	Name       string // video ID
+	Title      string
+	Tags       []string
+	UploadedAt time.Time
+	Views      int64
+	AudioOnly  bool
+	Live       bool
 }
 
-type folderInfos []folderInfo
-
 var (
-	AppConfig       Cfg
-	checkOldEvery   = time.Hour //wait time before recheck  file deletion policies
-	safeFileName    = regexp.MustCompile("^[a-zA-Z0-9_-]+(\\.[a-zA-Z0-9_]+)*$")
-	videosUploaded  int
-	quequelen       int = 0
-	templatefl          = template.Must(template.ParseFiles("pages/filelist.html"))
+	AppConfig           Cfg
+	checkOldEvery       = time.Hour //wait time before recheck  file deletion policies
+	safeFileName        = regexp.MustCompile("^[a-zA-Z0-9_-]+(\\.[a-zA-Z0-9_]+)*$")
+	quequelen           atomic.Int64
+	templateFuncs       = template.FuncMap{"pathEscape": url.PathEscape} // pathEscape for the tags and categories in the links
+	templatefl          = template.Must(template.New("filelist.html").Funcs(templateFuncs).ParseFiles("pages/filelist.html"))
 	templateq           = template.Must(template.ParseFiles("pages/queque.html"))
 	templateupl         = template.Must(template.ParseFiles("pages/uploaded.html"))
-	templatevp          = template.Must(template.ParseFiles("pages/vp.html"))
+	templatevp          = template.Must(template.New("vp.html").Funcs(templateFuncs).ParseFiles("pages/vp.html"))
 	templatevpemb       = template.Must(template.ParseFiles("pages/embedded.html"))
 	templatevpnojs      = template.Must(template.ParseFiles("pages/vpnojs.html"))
 	templateerr         = template.Must(template.ParseFiles("pages/error.html"))
 	templatesndfile     = template.Must(template.ParseFiles("pages/sendfile.html"))
 	templateConfig      = template.Must(template.ParseFiles("pages/editconfig.html"))
+	templatechapters    = template.Must(template.ParseFiles("pages/chapters.html"))
+	templateuplsummary  = template.Must(template.ParseFiles("pages/uploadsummary.html"))
+	templateeditvideo   = template.Must(template.ParseFiles("pages/editvideo.html"))
+	templatesearch      = template.Must(template.ParseFiles("pages/search.html"))
+	templatetags        = template.Must(template.New("tags.html").Funcs(templateFuncs).ParseFiles("pages/tags.html"))
+	templateplaylists   = template.Must(template.ParseFiles("pages/playlists.html"))
+	templateplaylist    = template.Must(template.ParseFiles("pages/playlist.html"))
 	videoQuality        = make(chan VideoParams)
-	channelOpen         = false
-	users           []User
-	cookieKeys      [][]byte // Array of secret keys for key rotation
-	currentKeyIndex int      // Index of the current secret key
+	startConvertWorkers sync.Once
+	users               []User
+	cookieKeys          [][]byte // Array of secret keys for key rotation
+	currentKeyIndex     int      // Index of the current secret key
 )
 
 const (
@@ -99,48 +161,143 @@ const (
 )
 
 type VideoParams struct {
-	videoPath    string
-	ConvertPath  string
-	quality      string
-	width        string
-	height       string
-	audio        bool
-	processaudio bool
-	audioquality string
-	creatempd    bool
-	videoName    string
-	createThunb  bool
+	videoPath      string
+	ConvertPath    string
+	quality        string
+	width          string
+	height         string
+	audio          bool
+	processaudio   bool
+	audioquality   string
+	creatempd      bool
+	encrypt        bool // CENC encryption of the renditions, see drm.go
+	videoName      string
+	createThunb    bool
+	waveform       bool
+	audioOnly      bool
+	outputDir      string        // folder of the converted video
+	done           chan struct{} // closed when the job is completed, if not nil
+	bypassSchedule bool          // run even outside the conversion windows
+	sceneDetect    bool
+	lowPriority    bool // run only when no other job is waiting
+	ctx            context.Context
+	timeout        time.Duration // max run time of the job, 0 = no timeout
+	duration       float64       // seconds of the source, for the progress of the job
+}
+
+type mediaInfo struct {
+	HasVideo  bool
+	HasAudio  bool
+	Duration  float64
+	Formats   []string // container format names reported by ffprobe, e.g. mov,mp4,m4a
+	Codecs    []string // codecs of the audio and video streams
+	Width     int
+	Height    int
+	FrameRate float64
+	Decodable int // number of audio/video streams with a known codec
+	Chapters  []chapter
 }
 
 type User struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	Role     string `yaml:"role"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	Role      string `yaml:"role"`
+	StreamKey string `yaml:"streamkey"`
 }
 
 type PageList struct {
-	Files     []folderInfo
-	PrevPage  int
-	NextPage  int
-	TotalPage int
-	CanDelete int
+	Files      []folderInfo
+	PrevPage   int
+	NextPage   int
+	TotalPage  int
+	CanDelete  int
+	Heading    string // title of the list, empty for the whole library
+	Categories []categoryLink
+}
+
+type PageTags struct {
+	Tags       []tagCount
+	Categories []categoryLink
 }
 
 type PageQueque struct {
-	QuequeSize int
+	QuequeSize     int
+	ScheduleStatus string
+	Conversions    []string
+	CanCancel      bool
+	Jobs           []jobEntry // last conversions, for the admins
 }
 
 type PageUploaded struct {
-	FileName      string
-	FileNameNoExt string
-	QuequeSize    int
+	FileName   string
+	VideoName  string
+	QuequeSize int
+	Importing  bool
+}
+type PageUploadSummary struct {
+	Results    []uploadResult
+	QuequeSize int
 }
 type PageVPEMB struct {
-	VidNm string
+	VidNm     string
+	Encrypted bool
+	Playlist  *playlistView
 }
 type PageVP struct {
-	VidNm string
-	Embed bool
+	VidNm       string
+	Encrypted   bool
+	Title       string
+	Description template.HTML
+	Tags        []string
+	Embed       bool
+	Live        bool
+	CanDownload bool
+	Chapters    []chapter
+	CanEdit     bool
+	Views       int64
+	Playlist    *playlistView   // playlist being played, nil without list=
+	MyPlaylists []playlistEntry // playlists the video can be added to
+}
+type PageEditVideo struct {
+	VidNm       string
+	Title       string
+	Description string
+	Tags        string
+	ErrMsg      string
+}
+type PageChapters struct {
+	VidNm       string
+	Text        string
+	ErrMsg      string
+	Suggestions []suggestedChapter
+	CanDetect   bool
+}
+type PageSearch struct {
+	Query   searchQuery
+	Results []searchResult
+	Total   int
+	PrevURL string
+	NextURL string
+}
+type PagePlaylist struct {
+	ID                  string
+	Title               string
+	Description         string // Markdown, for the edit form
+	RenderedDescription template.HTML
+	Visibility          string
+	Owner               string
+	Items               []playlistItem
+	CanEdit             bool
+	Embed               bool
+	ErrMsg              string
+}
+type PagePlaylists struct {
+	Playlists   []playlistEntry
+	CanCreate   bool
+	Title       string
+	Description string
+	Visibility  string
+	ErrMsg      string
 }
 type PageVPNoJS struct {
 	VidNm string
@@ -148,8 +305,15 @@ type PageVPNoJS struct {
 type PageErr struct {
 	ErrMsg string
 }
+type PageConfig struct {
+	Config     map[string]interface{}
+	RateLimits []rateLimitState
+}
+
 type PageSndFile struct {
-	UseAuth bool
+	UseAuth      bool
+	AllowPrivate bool
+	Quota        *quotaStatus
 }
 
 func main() {
@@ -180,17 +344,57 @@ func main() {
 		d = time.Hour
 	}
 	checkOldEvery = d
+	if _, err := parseConvWindows(AppConfig.ConvWindows); err != nil {
+		fmt.Println("Error parsing ConvWindows from config.yaml. Conversions will always run at full concurrency", err)
+	}
+
+	var stop context.CancelFunc
+	appCtx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := openStore(); err != nil {
+		fmt.Println("Error opening the database:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	if err := recoverStore(); err != nil {
+		fmt.Println("Error recovering the database:", err)
+	}
+	discardPrivateSceneSuggestions()
+
+	if len(os.Args) > 1 && os.Args[1] == "retranscode" {
+		retranscodeCommand(os.Args[2:])
+		return
+	}
 
 	if AppConfig.EnableFDP {
 		go deleteOLD()
 	}
+	if AppConfig.ArchiveOriginals {
+		go deleteOldArchives()
+	}
+	go deleteStaleTusUploads()
+	if AppConfig.WatchFolder != "" {
+		go watchFolder()
+	}
 
 	go resetVideoUploadedCounter()
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/vp", handleVP)
-	http.HandleFunc("/Send", handleSendVideo)
-	http.HandleFunc("/deleteVideo", handleDeleteVideo)
-	http.HandleFunc("/", http.HandlerFunc(listFolderHandler))
+	go deleteIdleRateLimits()
+	http.HandleFunc("/upload", rateLimited("upload", uploadHandler))
+	http.HandleFunc("/importurl", rateLimited("upload", importURLHandler))
+	http.HandleFunc("/tus/", rateLimited("upload", tusHandler))
+	http.HandleFunc("/vp", rateLimited("api", handleVP))
+	http.HandleFunc("/Send", rateLimited("api", handleSendVideo))
+	http.HandleFunc("/deleteVideo", rateLimited("api", handleDeleteVideo))
+	http.HandleFunc("/retranscode", rateLimited("api", retranscodeHandler))
+	http.HandleFunc("/original", rateLimited("media", downloadOriginalHandler))
+	http.HandleFunc("/cancelconversion", rateLimited("api", cancelConversionHandler))
+	http.HandleFunc("/chapters", rateLimited("api", editChaptersHandler))
+	http.HandleFunc("/editvideo", rateLimited("api", editVideoHandler))
+	http.HandleFunc("/chapters.vtt", rateLimited("api", chaptersVTTHandler))
+	http.HandleFunc("/chapters/scenes", rateLimited("api", sceneChaptersHandler))
+	http.HandleFunc("/license", rateLimited("api", licenseHandler))
+	http.HandleFunc("/", rateLimited("api", listFolderHandler))
 	http.Handle("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if AppConfig.VideoOnlyForUsers {
 			if !adminAuthenticated(r) && !userAuthenticated(r) {
@@ -201,7 +405,7 @@ func main() {
 		http.StripPrefix("/static", http.FileServer(http.Dir(staticPath))).ServeHTTP(w, r)
 	}))
 
-	http.Handle("/converted/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/converted/", rateLimited("media", func(w http.ResponseWriter, r *http.Request) {
 		if AppConfig.VideoOnlyForUsers {
 			if !adminAuthenticated(r) && !userAuthenticated(r) {
 				http.Redirect(w, r, "/auth", http.StatusSeeOther)
@@ -212,25 +416,56 @@ func main() {
 	}))
 
 	http.HandleFunc("/favicon.ico", http.HandlerFunc(faviconHandler))
-	http.HandleFunc("/lst", listFolderHandler)
-	http.HandleFunc("/queque", quequeSize)
-	http.HandleFunc("/editconfig", editConfigHandler)
-	http.HandleFunc("/save-config", saveConfigHandler)
-	http.HandleFunc("/auth", loginHandler)
+	http.HandleFunc("/lst", rateLimited("api", listFolderHandler))
+	http.HandleFunc("/search", rateLimited("api", searchHandler))
+	http.HandleFunc("/tags", rateLimited("api", tagCloudHandler))
+	http.HandleFunc("/tag/{tag...}", rateLimited("api", tagHandler))
+	http.HandleFunc("/category/{category}", rateLimited("api", categoryHandler))
+	http.HandleFunc("/playlists", rateLimited("api", playlistsHandler))
+	http.HandleFunc("/playlist", rateLimited("api", playlistHandler))
+	http.HandleFunc("/api/search", rateLimited("api", searchAPIHandler))
+	http.HandleFunc("/queque", rateLimited("api", quequeSize))
+	http.HandleFunc("/progress", rateLimited("api", progressHandler))
+	http.HandleFunc("/editconfig", rateLimited("api", editConfigHandler))
+	http.HandleFunc("/save-config", rateLimited("api", saveConfigHandler))
+	http.HandleFunc("/auth", rateLimited("login", loginHandler))
+	http.HandleFunc("/live/ingest", rateLimited("upload", liveIngestHandler))
+	var servers sync.WaitGroup
+	serverTLS := &http.Server{Addr: AppConfig.BindtoAdress + ":" + AppConfig.ServerPortTLS}
+	server := &http.Server{Addr: AppConfig.BindtoAdress + ":" + AppConfig.ServerPort}
 	if AppConfig.EnableTLS {
+		servers.Add(1)
 		go func() {
-			err := http.ListenAndServeTLS(AppConfig.BindtoAdress+":"+AppConfig.ServerPortTLS, AppConfig.CertPathCrt, AppConfig.CertPathKey, nil)
-			if err != nil {
+			defer servers.Done()
+			err := serverTLS.ListenAndServeTLS(AppConfig.CertPathCrt, AppConfig.CertPathKey)
+			if err != nil && err != http.ErrServerClosed {
 				fmt.Println(err)
 			}
 		}()
 	}
 	if AppConfig.EnableNoTLS {
-		err := http.ListenAndServe(AppConfig.BindtoAdress+":"+AppConfig.ServerPort, nil)
-		if err != nil {
-			fmt.Println(err)
-		}
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			err := server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				fmt.Println(err)
+			}
+		}()
 	}
+
+	// On shutdown the child processes (conversions, live streams) are killed before exiting
+	go func() {
+		<-appCtx.Done()
+		fmt.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		serverTLS.Shutdown(ctx)
+		server.Shutdown(ctx)
+	}()
+	servers.Wait()
+	stop()
+	activeCommands.Wait()
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -270,8 +505,14 @@ func editConfigHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	configMap := structToMap(&AppConfig)
-	if err := templateConfig.Execute(w, configMap); err != nil {
+	p := &PageConfig{
+		Config:     structToMap(&AppConfig),
+		RateLimits: rateLimitStates(),
+	}
+	if len(p.RateLimits) > 100 {
+		p.RateLimits = p.RateLimits[:100]
+	}
+	if err := templateConfig.Execute(w, p); err != nil {
 		sendError(w, r, "Error during template generation")
 		return
 	}
@@ -292,6 +533,15 @@ func structToMap(config *Cfg) map[string]interface{} {
 
 	// Convert MaxUploadSize to a normal string representation
 	configMap["MaxUploadSize"] = strconv.FormatInt(config.MaxUploadSize, 10)
+	configMap["ConvBypassSize"] = strconv.FormatInt(config.ConvBypassSize, 10)
+
+	// Structured options (lists, per role settings) can't be edited in the form, only in config.yaml
+	for key, value := range configMap {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}, nil:
+			delete(configMap, key)
+		}
+	}
 
 	return configMap
 }
@@ -337,7 +587,9 @@ func saveConfig(configPath string, config *Cfg) error {
 }
 
 func mapToStruct(configMap map[string]interface{}) *Cfg {
-	config := &Cfg{}
+	// Start from the current configuration to keep the options not available in the form
+	current := AppConfig
+	config := &current
 	for key, value := range configMap {
 		switch key {
 		case "EnableTLS":
@@ -362,6 +614,8 @@ func mapToStruct(configMap map[string]interface{}) *Cfg {
 			config.MaxVideosPerHour, _ = strconv.Atoi(value.(string))
 		case "MaxVideoNameLen":
 			config.MaxVideoNameLen, _ = strconv.Atoi(value.(string))
+		case "MaxTitleLen":
+			config.MaxTitleLen, _ = strconv.Atoi(value.(string))
 		case "VideoResLow":
 			config.VideoResLow = value.(string)
 		case "VideoResMed":
@@ -400,6 +654,86 @@ func mapToStruct(configMap map[string]interface{}) *Cfg {
 			config.VideoConvPreset = value.(string)
 		case "AllowEmbedded":
 			config.AllowEmbedded, _ = strconv.ParseBool(value.(string))
+		case "EnableLive":
+			config.EnableLive, _ = strconv.ParseBool(value.(string))
+		case "LiveArchive":
+			config.LiveArchive, _ = strconv.ParseBool(value.(string))
+		case "LiveSegDuration":
+			config.LiveSegDuration = value.(string)
+		case "LiveWindowSize":
+			config.LiveWindowSize, _ = strconv.Atoi(value.(string))
+		case "ArchiveOriginals":
+			config.ArchiveOriginals, _ = strconv.ParseBool(value.(string))
+		case "ArchivePath":
+			config.ArchivePath = value.(string)
+		case "ArchiveDaysOld":
+			config.ArchiveDaysOld, _ = strconv.Atoi(value.(string))
+		case "ArchiveCompress":
+			config.ArchiveCompress, _ = strconv.ParseBool(value.(string))
+		case "AllowOriginalDownload":
+			config.AllowOriginalDownload, _ = strconv.ParseBool(value.(string))
+		case "ConvWorkers":
+			config.ConvWorkers, _ = strconv.Atoi(value.(string))
+		case "ConvWindows":
+			config.ConvWindows = value.(string)
+		case "ConvOffPeakWorkers":
+			config.ConvOffPeakWorkers, _ = strconv.Atoi(value.(string))
+		case "ConvBypassSize":
+			config.ConvBypassSize, _ = strconv.ParseInt(value.(string), 10, 64)
+		case "ConvPriorityRole":
+			config.ConvPriorityRole = value.(string)
+		case "ConvTimeoutBase":
+			config.ConvTimeoutBase = value.(string)
+		case "ConvTimeoutFactor":
+			config.ConvTimeoutFactor, _ = strconv.Atoi(value.(string))
+		case "ConvNice":
+			config.ConvNice, _ = strconv.Atoi(value.(string))
+		case "ConvIOClass":
+			config.ConvIOClass = value.(string)
+		case "ConvMemLimitMB":
+			config.ConvMemLimitMB, _ = strconv.Atoi(value.(string))
+		case "EnableSceneChapters":
+			config.EnableSceneChapters, _ = strconv.ParseBool(value.(string))
+		case "SceneThreshold":
+			config.SceneThreshold = value.(string)
+		case "SceneMinGap":
+			config.SceneMinGap, _ = strconv.Atoi(value.(string))
+		case "SceneMaxChapters":
+			config.SceneMaxChapters, _ = strconv.Atoi(value.(string))
+		case "TusExpiration":
+			config.TusExpiration = value.(string)
+		case "AllowPrivateVideos":
+			config.AllowPrivateVideos, _ = strconv.ParseBool(value.(string))
+		case "KeyPath":
+			config.KeyPath = value.(string)
+		case "WatchFolder":
+			config.WatchFolder = value.(string)
+		case "WatchInterval":
+			config.WatchInterval, _ = strconv.Atoi(value.(string))
+		case "WatchUploader":
+			config.WatchUploader = value.(string)
+		case "EnableURLImport":
+			config.EnableURLImport, _ = strconv.ParseBool(value.(string))
+		case "ImportAllowHosts":
+			config.ImportAllowHosts = value.(string)
+		case "ImportDenyHosts":
+			config.ImportDenyHosts = value.(string)
+		case "ImportAllowPrivate":
+			config.ImportAllowPrivate, _ = strconv.ParseBool(value.(string))
+		case "TrustedProxies":
+			config.TrustedProxies = value.(string)
+		case "Scanner":
+			config.Scanner = value.(string)
+		case "ClamdAddress":
+			config.ClamdAddress = value.(string)
+		case "ScanCommand":
+			config.ScanCommand = value.(string)
+		case "QuarantinePath":
+			config.QuarantinePath = value.(string)
+		case "DatabasePath":
+			config.DatabasePath = value.(string)
+		case "ImportRetries":
+			config.ImportRetries, _ = strconv.Atoi(value.(string))
 		}
 	}
 	return config
@@ -409,9 +743,33 @@ func faviconHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, faviconPath)
 }
 
+// cancelConversionHandler stops the conversion of a video, its folder is removed.
+func cancelConversionHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthenticated(r) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	videoname := r.URL.Query().Get("videoname")
+	if !cancelConversion(videoname) {
+		sendError(w, r, "No conversion running for "+videoname)
+		return
+	}
+	http.Redirect(w, r, "/queque", http.StatusSeeOther)
+}
+
 func quequeSize(w http.ResponseWriter, r *http.Request) {
 	p := &PageQueque{
-		QuequeSize: quequelen,
+		QuequeSize:     int(quequelen.Load()),
+		ScheduleStatus: convSchedule.status(),
+		Conversions:    runningConversions(),
+		CanCancel:      adminAuthenticated(r),
+	}
+	if p.CanCancel {
+		jobs, err := recentJobs(20)
+		if err != nil {
+			fmt.Println("Error reading the jobs:", err)
+		}
+		p.Jobs = jobs
 	}
 	renderTemplate(w, "queque", p)
 }
@@ -438,6 +796,14 @@ func adminAuthenticated(r *http.Request) bool {
 }
 
 func listFolderHandler(w http.ResponseWriter, r *http.Request) {
+	renderVideoList(w, r, "", func(meta videoMeta) bool {
+		return true
+	})
+}
+
+// renderVideoList shows a page of the Video List with the videos for which filter returns true, among the ones
+// the request can view. It is used for the whole library, the tags and the categories.
+func renderVideoList(w http.ResponseWriter, r *http.Request, heading string, filter func(meta videoMeta) bool) {
 	if AppConfig.VideoOnlyForUsers && !adminAuthenticated(r) && !userAuthenticated(r) {
 		http.Redirect(w, r, "/auth", http.StatusSeeOther)
 		return
@@ -448,23 +814,26 @@ func listFolderHandler(w http.ResponseWriter, r *http.Request) {
 		pageNum = page
 	}
 
-	const dirPath = "converted"
-	folders, err := listFolders(dirPath, pageNum)
+	folders, total, err := listFolders(pageNum, func(meta videoMeta) bool {
+		return filter(meta) && canViewVideo(r, meta)
+	})
 	if err != nil {
 		sendError(w, r, err.Error())
 		return
 	}
 
 	data := &PageList{
-		Files:     folders,
-		TotalPage: (len(folders) + (AppConfig.VideoPerPage - 1)) / AppConfig.VideoPerPage,
+		Files:      folders,
+		TotalPage:  (total + (videosPerPage() - 1)) / videosPerPage(),
+		Heading:    heading,
+		Categories: categoryLinks(),
 	}
 
 	if pageNum > 1 {
 		data.PrevPage = pageNum - 1
 	}
 
-	if len(folders) == AppConfig.VideoPerPage {
+	if pageNum < data.TotalPage {
 		data.NextPage = pageNum + 1
 	}
 	if adminAuthenticated(r) {
@@ -481,228 +850,450 @@ func handleDeleteVideo(w http.ResponseWriter, r *http.Request) {
 	}
 	videoname := r.URL.Query().Get("videoname")
 	if isSafeFileName(videoname) {
-		err := os.RemoveAll(filepath.Join(AppConfig.ConvertPath, videoname))
-		if err != nil {
+		if err := deleteVideo(videoname); err != nil {
 			sendError(w, r, err.Error())
 			return
 		}
 	}
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	if AppConfig.AllowUploadOnlyFromAdmins {
-		if !adminAuthenticated(r) {
-			http.Redirect(w, r, "/auth", http.StatusSeeOther)
-			return
-		}
+// deleteVideo removes a video: its renditions, its record in the database and its content key.
+func deleteVideo(videoname string) error {
+	if err := os.RemoveAll(filepath.Join(AppConfig.ConvertPath, videoname)); err != nil {
+		return err
 	}
-	if AppConfig.AllowUploadOnlyFromUsers {
-		if !adminAuthenticated(r) && !userAuthenticated(r) {
-			http.Redirect(w, r, "/auth", http.StatusSeeOther)
-			return
-		}
-	}
-	file, header, err := r.FormFile("video")
+	deleteContentKey(videoname)
+	return deleteVideoRecord(videoname)
+}
 
-	var errormsg string
-	if err != nil {
+// uploadHandler streams the uploaded files straight to UploadPath with multipart.Reader, so nothing is
+// buffered in the temp folder. The request stops being read at the first file exceeding the size,
+// name or rate limits.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !canUpload(w, r) {
+		return
+	}
+	if err := checkUploadLimits(requestUsername(r), requestRole(r)); err != nil {
 		sendError(w, r, err.Error())
 		return
 	}
-	defer file.Close()
-
-	if header.Size > AppConfig.MaxUploadSize {
-		errormsg = "The uploaded file is too big: " + header.Filename + ". Max size allowed: " + strconv.FormatInt(AppConfig.MaxUploadSize, 10)
+	// MaxUploadSize plus some room for the multipart headers and the form fields
+	maxRequestSize := AppConfig.MaxUploadSize + 1<<20
+	if r.ContentLength > maxRequestSize {
+		w.Header().Set("Connection", "close")
+		sendError(w, r, "The upload is too big. Max size allowed: "+strconv.FormatInt(AppConfig.MaxUploadSize, 10))
+		return
 	}
-	filename := header.Filename
-	if len(filename) > AppConfig.MaxVideoNameLen || !isSafeFileName(filename) {
-		errormsg = "Invalid file name: either it contains invalid characters or it's longer than " + strconv.Itoa(AppConfig.MaxVideoNameLen) + " characters"
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
 	}
 
-	//check if the maxium video per h is reached
-	if videosUploaded >= AppConfig.MaxVideosPerHour {
-		errormsg = "Can't upload more than" + strconv.Itoa(AppConfig.MaxVideosPerHour) + "videos per hour"
+	role := requestRole(r)
+	meta := newVideoMeta(requestUsername(r), "")
+	details := make(map[string]string)
+	var results []uploadResult
+	aborted := false
+	for !aborted {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			results = append(results, uploadResult{FileName: "-", Err: err.Error()})
+			break
+		}
+		switch {
+		case part.FormName() == "private":
+			// The private checkbox and the details come before the files in the form
+			meta.Private = AppConfig.AllowPrivateVideos && meta.Uploader != ""
+		case part.FormName() == "title" || part.FormName() == "description" || part.FormName() == "tags":
+			value, err := io.ReadAll(io.LimitReader(part, 64<<10))
+			if err != nil {
+				results = append(results, uploadResult{FileName: "-", Err: err.Error()})
+				aborted = true
+				break
+			}
+			details[part.FormName()] = string(value)
+			if err := setVideoDetails(&meta, details["title"], details["description"], details["tags"]); err != nil {
+				results = append(results, uploadResult{FileName: "-", Err: err.Error()})
+				aborted = true
+			}
+		case part.FormName() == "video" && part.FileName() != "":
+			if isUploadArchive(part.FileName()) {
+				archiveResults := storeUploadArchive(part.FileName(), part, role, meta)
+				if len(archiveResults) == 0 {
+					archiveResults = []uploadResult{{FileName: part.FileName(), Err: "The archive doesn't contain any file"}}
+				}
+				results = append(results, archiveResults...)
+			} else {
+				results = append(results, storeUpload(part.FileName(), part, role, meta))
+			}
+			aborted = results[len(results)-1].abort
+		}
+		part.Close()
 	}
-
-	extension := path.Ext(filename)
-	filenamenoext := strings.TrimSuffix(filename, extension)
-
-	// Sanitize the file path
-	filePath := filepath.Join(AppConfig.UploadPath, filepath.Clean(filename))
-	if !strings.HasPrefix(filePath, AppConfig.UploadPath) {
-		errormsg = "Invalid file name"
-		sendError(w, r, errormsg)
-		return
+	if aborted {
+		// Don't wait for the rest of the upload
+		w.Header().Set("Connection", "close")
 	}
-
-	// Check if the file already exists
-	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
-		errormsg = "File already exists: " + filename
-		sendError(w, r, errormsg)
+	if len(results) == 0 {
+		sendError(w, r, "No file uploaded")
 		return
 	}
 
-	if errormsg != "" {
-		sendError(w, r, errormsg)
-		return
+	p := &PageUploadSummary{
+		Results:    results,
+		QuequeSize: int(quequelen.Load()),
 	}
+	renderTemplate(w, "uploadsummary", p)
+}
 
-	out, err := os.Create(filePath)
-	if err != nil {
-		sendError(w, r, err.Error())
+func StartconvertVideo(filePath, ConvertPath, filenamenoext string, meta videoMeta) {
+	if err := runConversion(filePath, ConvertPath, filenamenoext, false, &meta); err != nil {
+		fmt.Println(err)
 		return
 	}
-	defer out.Close()
-
-	videosUploaded++
-
-	_, err = io.Copy(out, file)
-	if err != nil {
-		sendError(w, r, err.Error())
-		return
+	if AppConfig.EnableSceneChapters {
+		if chapters, err := loadChapters(ConvertPath, filenamenoext); err == nil && len(chapters) == 0 && !isAudioOnly(ConvertPath, filenamenoext) {
+			if err := queueSceneDetection(ConvertPath, filenamenoext); err != nil {
+				fmt.Println("Scene detection of", filenamenoext, "skipped:", err)
+			}
+		}
 	}
 
-	go StartconvertVideo(filePath, AppConfig.ConvertPath, filenamenoext)
-	p := &PageUploaded{
-		FileName:      filename,
-		FileNameNoExt: filenamenoext,
-		QuequeSize:    quequelen,
+	if AppConfig.ArchiveOriginals {
+		archivePath, err := archiveOriginal(filePath, filenamenoext)
+		if err != nil {
+			fmt.Println("error archiving original video file:", err)
+			return
+		}
+		// The details may have been edited during the conversion
+		err = updateVideoMeta(filenamenoext, func(meta *videoMeta) {
+			meta.ArchiveFile = archivePath
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+	} else if AppConfig.DelVidAftUpl {
+		err := os.Remove(filePath)
+		if err != nil {
+			fmt.Println("error removing original video file:", err)
+		}
 	}
-	renderTemplate(w, "uploaded", p)
 }
 
-func StartconvertVideo(filePath, ConvertPath, filenamenoext string) {
+// runConversion queues all the conversion jobs of a video in ConvertPath/filenamenoext and waits for the MPD creation.
+// removeSource is used for temporary source files, meta is saved in the database if not nil.
+func runConversion(filePath, ConvertPath, filenamenoext string, removeSource bool, meta *videoMeta) error {
 	convertedBasePath := filepath.Join(ConvertPath, filenamenoext)
 	dirPath := filepath.Join(ConvertPath, filenamenoext)
+	// finish publishes the outcome of the conversion and records it in the jobs
+	finish := func(stage, message string) {
+		setProgressStage(filenamenoext, stage, message)
+		recordJob(filenamenoext, stage, message)
+	}
 
+	startProgress(filenamenoext)
+	recordJob(filenamenoext, stageQueued, "")
 	err := os.Mkdir(filepath.Clean(dirPath), 0755)
 	if err != nil {
-		fmt.Println(err)
-		return
+		finish(stageFailed, "Conversion failed")
+		return err
 	}
-	quequelen += 7
+	quequelen.Add(7)
+	ctx, unregister := registerConversion(filenamenoext)
+	defer unregister()
 
-	if !channelOpen {
+	startConvertWorkers.Do(func() {
 		go convertVideo(videoQuality)
-		channelOpen = true
+	})
+
+	info, err := probeMedia(filePath)
+	if err != nil {
+		fmt.Println("Error probing", filePath, err)
+	}
+	audioOnly := err == nil && !info.HasVideo && info.HasAudio
+	if meta != nil {
+		meta.Duration = info.Duration
+		meta.AudioOnly = audioOnly
+		if err := saveVideoMeta(filenamenoext, *meta); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if len(info.Chapters) > 0 {
+		if err := saveChapters(ConvertPath, filenamenoext, chaptersFromProbe(info.Chapters)); err != nil {
+			fmt.Println(err)
+		}
 	}
 
-	var wglowqualityconv, wg sync.WaitGroup
-	wglowqualityconv.Add(2)
-	wg.Add(4)
+	// Small or priority jobs are not delayed by the conversion schedule
+	bypass := meta != nil && isPriorityUploader(meta.Uploader)
+	if fi, err := os.Stat(filePath); err == nil && fi.Size() < AppConfig.ConvBypassSize {
+		bypass = true
+	}
+
+	timeout := convTimeout(info.Duration)
+	// Private videos are encrypted, they don't get the unencrypted WebM fallback
+	encrypt := meta != nil && meta.Private
+
+	jobs := 6 // ffmpeg jobs, the MPD creation is reported as packaging
+	if audioOnly {
+		jobs = 3
+	}
+	if encrypt {
+		jobs--
+	}
+	setProgressJobs(filenamenoext, jobs)
 
 	launchConversion := func(params VideoParams, wg *sync.WaitGroup) {
+		params.bypassSchedule = bypass
+		params.ctx = ctx
+		params.timeout = timeout
+		params.duration = info.Duration
+		params.done = make(chan struct{})
 		videoQuality <- params
+		<-params.done
 		wg.Done()
 	}
 
-	go launchConversion(VideoParams{filePath, filepath.Join(convertedBasePath, "low_"+filenamenoext+"_audio.webm"), AppConfig.BitRateLow, AppConfig.VideoResLow, "-2", true, false, "64k", false, filenamenoext, false}, &wglowqualityconv)
-	go launchConversion(VideoParams{filePath, filepath.Join(convertedBasePath, "output.jpeg"), AppConfig.BitRateHigh, AppConfig.VideoResHigh, "-2", false, false, "64k", false, filenamenoext, true}, &wglowqualityconv)
-	wglowqualityconv.Wait()
+	if audioOnly {
+		// Audio only source (podcast, voice memo...): no video renditions, a waveform is used as poster
+		audioOnlyFilePath := filepath.Join(dirPath, filenamenoext+"audioonly.txt")
+		file, err := os.Create(filepath.Clean(audioOnlyFilePath))
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			file.Close()
+		}
+		quequelen.Add(-3) // 4 jobs instead of 7
+
+		var wgaudio sync.WaitGroup
+		wgaudio.Add(2)
+		if encrypt {
+			quequelen.Add(-1)
+		} else {
+			wgaudio.Add(1)
+			go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "low_"+filenamenoext+"_audio.webm"), audio: true, audioOnly: true, audioquality: "64k", videoName: filenamenoext, outputDir: convertedBasePath}, &wgaudio)
+		}
+		go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "output.jpeg"), waveform: true, videoName: filenamenoext, outputDir: convertedBasePath}, &wgaudio)
+		go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "audio_"+filenamenoext+".mp4"), processaudio: true, audioquality: "128k", videoName: filenamenoext, outputDir: convertedBasePath}, &wgaudio)
+		wgaudio.Wait()
+	} else {
+		var wglowqualityconv, wg sync.WaitGroup
+		wglowqualityconv.Add(1)
+		wg.Add(4)
+
+		if encrypt {
+			quequelen.Add(-1)
+		} else {
+			wglowqualityconv.Add(1)
+			go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "low_"+filenamenoext+"_audio.webm"), quality: AppConfig.BitRateLow, width: AppConfig.VideoResLow, height: "-2", audio: true, audioquality: "64k", videoName: filenamenoext, outputDir: convertedBasePath}, &wglowqualityconv)
+		}
+		go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "output.jpeg"), quality: AppConfig.BitRateHigh, width: AppConfig.VideoResHigh, height: "-2", audioquality: "64k", videoName: filenamenoext, outputDir: convertedBasePath, createThunb: true}, &wglowqualityconv)
+		wglowqualityconv.Wait()
+
+		go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "low_"+filenamenoext+".mp4"), quality: AppConfig.BitRateLow, width: AppConfig.VideoResLow, height: "-2", audioquality: "64k", videoName: filenamenoext, outputDir: convertedBasePath}, &wg)
+		go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "med_"+filenamenoext+".mp4"), quality: AppConfig.BitRateMed, width: AppConfig.VideoResMed, height: "-2", audioquality: "64k", videoName: filenamenoext, outputDir: convertedBasePath}, &wg)
+		go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "high_"+filenamenoext+".mp4"), quality: AppConfig.BitRateHigh, width: AppConfig.VideoResHigh, height: "-2", audioquality: "64k", videoName: filenamenoext, outputDir: convertedBasePath}, &wg)
+		go launchConversion(VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "audio_"+filenamenoext+".mp4"), quality: AppConfig.BitRateHigh, width: AppConfig.VideoResHigh, height: "-2", processaudio: true, audioquality: "64k", videoName: filenamenoext, outputDir: convertedBasePath}, &wg)
+		wg.Wait()
+	}
 
-	go launchConversion(VideoParams{filePath, filepath.Join(convertedBasePath, "low_"+filenamenoext+".mp4"), AppConfig.BitRateLow, AppConfig.VideoResLow, "-2", false, false, "64k", false, filenamenoext, false}, &wg)
-	go launchConversion(VideoParams{filePath, filepath.Join(convertedBasePath, "med_"+filenamenoext+".mp4"), AppConfig.BitRateMed, AppConfig.VideoResMed, "-2", false, false, "64k", false, filenamenoext, false}, &wg)
-	go launchConversion(VideoParams{filePath, filepath.Join(convertedBasePath, "high_"+filenamenoext+".mp4"), AppConfig.BitRateHigh, AppConfig.VideoResHigh, "-2", false, false, "64k", false, filenamenoext, false}, &wg)
-	go launchConversion(VideoParams{filePath, filepath.Join(convertedBasePath, "audio_"+filenamenoext+".mp4"), AppConfig.BitRateHigh, AppConfig.VideoResHigh, "-2", false, true, "64k", false, filenamenoext, false}, &wg)
-	wg.Wait()
+	mpdDone := make(chan struct{})
+	videoQuality <- VideoParams{videoPath: filePath, ConvertPath: filepath.Join(convertedBasePath, "output.mpd"), audioquality: "64k", creatempd: true, encrypt: encrypt, videoName: filenamenoext, outputDir: convertedBasePath, done: mpdDone, bypassSchedule: bypass, ctx: ctx, timeout: timeout}
+	<-mpdDone
 
-	videoQuality <- VideoParams{filePath, filepath.Join(convertedBasePath, "output.mpd"), AppConfig.BitRateHigh, AppConfig.VideoResHigh, "-2", false, false, "64k", true, filenamenoext, false}
+	if ctx.Err() != nil {
+		// Cancelled from the admin page or server shutdown: the renditions are incomplete
+		if err := os.RemoveAll(dirPath); err != nil {
+			fmt.Println(err)
+		}
+		// A re-transcoding runs in its work folder, the record and the current renditions stay
+		if ConvertPath == AppConfig.ConvertPath {
+			if err := deleteVideoRecord(filenamenoext); err != nil {
+				fmt.Println(err)
+			}
+		}
+		finish(stageFailed, "Conversion cancelled")
+		return fmt.Errorf("conversion of %s cancelled", filenamenoext)
+	}
+	if _, err := os.Stat(filepath.Join(dirPath, "output.mpd")); err != nil {
+		finish(stageFailed, "Conversion failed")
+	} else {
+		err := updateVideoMeta(filenamenoext, func(meta *videoMeta) {
+			meta.Size = dirSize(dirPath)
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+		finish(stageReady, "")
+	}
 
-	if AppConfig.DelVidAftUpl {
+	if removeSource {
 		err := os.Remove(filePath)
 		if err != nil {
-			fmt.Println("error removing original video file:", err)
+			fmt.Println("error removing temporary source file:", err)
 		}
 	}
+	return nil
 }
 
 func convertVideo(videoQuality chan VideoParams) {
-	runCommand := func(cmd *exec.Cmd, description string) {
-		err := cmd.Run()
+	runCommand := func(ctx context.Context, cmd *exec.Cmd, description string) {
+		err := runConvCommand(ctx, cmd)
 		if err != nil {
 			fmt.Printf("Error %s: %v\n", description, err)
 		} else {
 			fmt.Println(description)
 		}
-		quequelen--
+		quequelen.Add(-1)
 	}
 
-	createMPD := func(params VideoParams) {
-		outputPath := filepath.Join(AppConfig.ConvertPath, params.videoName)
+	createMPD := func(ctx context.Context, params VideoParams) {
+		outputPath := params.outputDir
 		dashMap := "-dash 2000 -frag 2000 -rap -profile onDemand -out "
 		mpdInuput := " " + outputPath + "/high_" + params.videoName + ".mp4#video " + outputPath + "/med_" + params.videoName + ".mp4#video " + outputPath + "/low_" + params.videoName + ".mp4#video "
 		noAudioFilePath := filepath.Join(outputPath, params.videoName+"noaudio.txt")
-		if _, err := os.Stat(filepath.Clean(noAudioFilePath)); os.IsNotExist(err) {
+		if isAudioOnly(filepath.Dir(outputPath), params.videoName) {
+			mpdInuput = " " + outputPath + "/audio_" + params.videoName + ".mp4#audio "
+		} else if _, err := os.Stat(filepath.Clean(noAudioFilePath)); os.IsNotExist(err) {
 			mpdInuput = mpdInuput + outputPath + "/audio_" + params.videoName + ".mp4#audio "
 		}
-		input := "MP4Box " + dashMap + params.ConvertPath + mpdInuput
-		cmd := exec.Command("/bin/sh", "-c", input)
-
-		err := cmd.Run()
-		if err != nil {
-			fmt.Println(err)
-		}
-		fmt.Println("MPD creation END ", params.videoName)
 		files := []string{
 			filepath.Join(outputPath, "low_"+params.videoName+".mp4"),
 			filepath.Join(outputPath, "med_"+params.videoName+".mp4"),
 			filepath.Join(outputPath, "high_"+params.videoName+".mp4"),
 			filepath.Join(outputPath, "audio_"+params.videoName+".mp4"),
 		}
-		for _, f := range files {
-			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
-				fmt.Printf("error removing file %s: %v\n", f, err)
+		defer func() {
+			for _, f := range files {
+				if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+					fmt.Printf("error removing file %s: %v\n", f, err)
+				}
 			}
+			quequelen.Add(-1)
+		}()
+
+		setProgressStage(params.videoName, stagePackaging, "")
+		var key contentKey
+		if params.encrypt {
+			var err error
+			if key, err = encryptRenditions(ctx, params.videoName, files); err != nil {
+				// Never publish the renditions of a private video unencrypted
+				fmt.Println("Error encrypting", params.videoName, err)
+				return
+			}
+		}
+
+		input := "MP4Box " + dashMap + params.ConvertPath + mpdInuput
+		cmd := newConvCommand(ctx, "/bin/sh", "-c", input)
+
+		err := runConvCommand(ctx, cmd)
+		if err != nil {
+			fmt.Println(err)
 		}
-		quequelen--
+		if params.encrypt && err == nil {
+			if err := addClearKeyProtection(params.ConvertPath, params.videoName, key); err != nil {
+				fmt.Println("Error adding ContentProtection to", params.ConvertPath, err)
+				os.Remove(params.ConvertPath)
+			}
+		}
+		fmt.Println("MPD creation END ", params.videoName)
 	}
 
-	for params := range videoQuality {
-		if params.audio {
-			cmd := exec.Command("/usr/bin/ffmpeg", "-i", params.videoPath, "-map_metadata", "-2", "-threads", AppConfig.NrOfCoreVideoConv, "-c:v", "libvpx-vp9", "-b:v", params.quality, "-vf", "scale="+params.width+":"+params.height, params.ConvertPath)
-			runCommand(cmd, fmt.Sprintf("%s converted to %s resolution %sx%s with audio", params.videoPath, params.quality, params.width, params.height))
+	runJob := func(params VideoParams) {
+		ctx := params.ctx
+		if ctx == nil {
+			ctx = appCtx
+		}
+		if params.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, params.timeout)
+			defer cancel()
+		}
+		if params.audio && params.audioOnly {
+			cmd := newFFmpegCommand(ctx, params, "-i", params.videoPath, "-map_metadata", "-2", "-threads", AppConfig.NrOfCoreVideoConv, "-vn", "-c:a", "libopus", "-b:a", params.audioquality, params.ConvertPath)
+			runCommand(ctx, cmd, fmt.Sprintf("%s converted to audio only webm", params.videoPath))
+		} else if params.audio {
+			cmd := newFFmpegCommand(ctx, params, "-i", params.videoPath, "-map_metadata", "-2", "-threads", AppConfig.NrOfCoreVideoConv, "-c:v", "libvpx-vp9", "-b:v", params.quality, "-vf", "scale="+params.width+":"+params.height, params.ConvertPath)
+			runCommand(ctx, cmd, fmt.Sprintf("%s converted to %s resolution %sx%s with audio", params.videoPath, params.quality, params.width, params.height))
 		} else if params.createThunb {
-			cmd := exec.Command("/usr/bin/ffmpeg", "-i", params.videoPath, "-map_metadata", "-2", "-ss", "00:00:01", "-vframes", "1", "-s", "640x480", "-f", "image2", params.ConvertPath)
-			runCommand(cmd, fmt.Sprintf("%s thumbnail created", params.videoPath))
+			cmd := newFFmpegCommand(ctx, params, "-i", params.videoPath, "-map_metadata", "-2", "-ss", "00:00:01", "-vframes", "1", "-s", "640x480", "-f", "image2", params.ConvertPath)
+			runCommand(ctx, cmd, fmt.Sprintf("%s thumbnail created", params.videoPath))
+		} else if params.waveform {
+			cmd := newFFmpegCommand(ctx, params, "-i", params.videoPath, "-map_metadata", "-2", "-filter_complex", "showwavespic=s=640x480:colors=0x2196F3", "-frames:v", "1", "-f", "image2", params.ConvertPath)
+			runCommand(ctx, cmd, fmt.Sprintf("%s waveform created", params.videoPath))
 		} else if params.processaudio {
-			cmd := exec.Command("/usr/bin/ffmpeg", "-i", params.videoPath, "-map_metadata", "-2", "-threads", AppConfig.NrOfCoreVideoConv, "-c:a", "aac", "-b:a", params.audioquality, "-vn", "-f", "mp4", params.ConvertPath)
-			err := cmd.Run()
+			cmd := newFFmpegCommand(ctx, params, "-i", params.videoPath, "-map_metadata", "-2", "-threads", AppConfig.NrOfCoreVideoConv, "-c:a", "aac", "-b:a", params.audioquality, "-vn", "-f", "mp4", params.ConvertPath)
+			err := runConvCommand(ctx, cmd)
 			if err != nil {
 				fmt.Println(err)
-				noAudioFilePath := filepath.Join(AppConfig.ConvertPath, params.videoName, params.videoName+"noaudio.txt")
+				noAudioFilePath := filepath.Join(params.outputDir, params.videoName+"noaudio.txt")
 				file, err := os.Create(filepath.Clean(noAudioFilePath))
 				if err != nil {
 					fmt.Println(err)
-					return
+				} else {
+					file.Close()
 				}
-				defer file.Close()
 			}
 			fmt.Println("Audio conversion end: ", params.videoName)
-			quequelen--
+			quequelen.Add(-1)
 		} else if params.creatempd {
-			createMPD(params)
+			createMPD(ctx, params)
+		} else if params.sceneDetect {
+			if err := detectScenes(ctx, params); err != nil {
+				fmt.Println(err)
+			}
+			quequelen.Add(-1)
 		} else {
-			cmd := exec.Command("/usr/bin/ffmpeg", "-i", params.videoPath, "-map_metadata", "-2", "-threads", AppConfig.NrOfCoreVideoConv, "-c:v", "libx264", "-level", "4.1", "-b:v", params.quality, "-g", "60", "-vf", "scale="+params.width+":"+params.height, "-preset", AppConfig.VideoConvPreset, "-keyint_min", "60", "-sc_threshold", "0", "-an", "-f", "mp4", "-dash", "1", params.ConvertPath)
-			runCommand(cmd, fmt.Sprintf("%s converted to %s resolution %sx%s", params.videoPath, params.quality, params.width, params.height))
+			cmd := newFFmpegCommand(ctx, params, "-i", params.videoPath, "-map_metadata", "-2", "-threads", AppConfig.NrOfCoreVideoConv, "-c:v", "libx264", "-level", "4.1", "-b:v", params.quality, "-g", "60", "-vf", "scale="+params.width+":"+params.height, "-preset", AppConfig.VideoConvPreset, "-keyint_min", "60", "-sc_threshold", "0", "-an", "-f", "mp4", "-dash", "1", params.ConvertPath)
+			runCommand(ctx, cmd, fmt.Sprintf("%s converted to %s resolution %sx%s", params.videoPath, params.quality, params.width, params.height))
 		}
 	}
+
+	// Every job waits for a slot of the conversion schedule, see convSchedule
+	for params := range videoQuality {
+		go func(params VideoParams) {
+			ctx := params.ctx
+			if ctx == nil {
+				ctx = appCtx
+			}
+			if !convSchedule.acquire(ctx, params.bypassSchedule, params.lowPriority) {
+				// Cancelled while queued: the job fails at once without a slot
+				runJob(params)
+				if params.done != nil {
+					close(params.done)
+				}
+				return
+			}
+			job := filepath.Base(params.ConvertPath)
+			tracked := !params.creatempd && !params.sceneDetect
+			if tracked {
+				setJobProgress(params.videoName, job, 0)
+			}
+			runJob(params)
+			if tracked {
+				setJobProgress(params.videoName, job, 1)
+			}
+			convSchedule.release()
+			if params.done != nil {
+				close(params.done)
+			}
+		}(params)
+	}
 }
 
 func handleSendVideo(w http.ResponseWriter, r *http.Request) {
-	if AppConfig.AllowUploadOnlyFromAdmins {
-		if !adminAuthenticated(r) {
-			http.Redirect(w, r, "/auth", http.StatusSeeOther)
-			return
-		}
-	}
-	if AppConfig.AllowUploadOnlyFromUsers {
-		if !adminAuthenticated(r) && !userAuthenticated(r) {
-			http.Redirect(w, r, "/auth", http.StatusSeeOther)
-			return
-		}
+	if !canUpload(w, r) {
+		return
 	}
 	p := &PageSndFile{
-		UseAuth: AppConfig.AllowUploadOnlyFromUsers, //TODO: REMOVE TEMPLATE, use static page
+		UseAuth:      AppConfig.AllowUploadOnlyFromUsers, //TODO: REMOVE TEMPLATE, use static page
+		AllowPrivate: AppConfig.AllowPrivateVideos && requestUsername(r) != "",
+		Quota:        newQuotaStatus(requestUsername(r), requestRole(r)),
 	}
 	renderTemplate(w, "sendfile", p)
 	return
@@ -719,15 +1310,64 @@ func handleVP(w http.ResponseWriter, r *http.Request) {
 	nojs := r.URL.Query().Get("nojs")
 	emb := r.URL.Query().Get("embedded")
 
-	if len(videoname) <= AppConfig.MaxVideoNameLen && isSafeFileName(videoname) {
+	// With list= the player shows the playlist and goes on with its next video, the first one if videoname is empty
+	var list *playlistView
+	if listID := r.URL.Query().Get("list"); listID != "" && nojs != "1" {
+		pl, found, err := findPlaylist(listID)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		if !found {
+			sendError(w, r, "Playlist not found")
+			return
+		}
+		if !canViewPlaylist(r, pl) {
+			http.Redirect(w, r, "/auth", http.StatusSeeOther)
+			return
+		}
+		list, err = newPlaylistView(r, listID, pl, videoname, emb == "1" && AppConfig.AllowEmbedded)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		if list.Current == "" {
+			sendError(w, r, "The playlist is empty")
+			return
+		}
+		videoname = list.Current
+	}
+
+	if isValidVideoID(videoname) {
+		meta, found, err := findVideo(videoname)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		if !found {
+			sendError(w, r, "Video not found")
+			return
+		}
+		if !canViewVideo(r, meta) {
+			http.Redirect(w, r, "/auth", http.StatusSeeOther)
+			return
+		}
+		views := countView(videoname)
+
 		if emb == "1" && AppConfig.AllowEmbedded {
 			p := &PageVPEMB{
-				VidNm: videoname,
+				VidNm:     videoname,
+				Encrypted: meta.Private,
+				Playlist:  list,
 			}
 			renderTemplate(w, "embedded", p)
 			return
 		}
 		if nojs == "1" {
+			if meta.Private {
+				sendError(w, r, "Private videos can be played only with JavaScript enabled")
+				return
+			}
 			p := &PageVPNoJS{
 				VidNm: videoname,
 			}
@@ -735,14 +1375,29 @@ func handleVP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		chapters, err := loadChapters(AppConfig.ConvertPath, videoname)
+		if err != nil {
+			fmt.Println(err)
+		}
 		p := &PageVP{
-			VidNm: videoname,
-			Embed: AppConfig.AllowEmbedded,
+			VidNm:       videoname,
+			Encrypted:   meta.Private,
+			Title:       meta.Title,
+			Description: renderDescription(meta.Description),
+			Tags:        meta.Tags,
+			Embed:       AppConfig.AllowEmbedded && !meta.Private,
+			Live:        meta.Live,
+			CanDownload: canDownloadOriginal(r, meta),
+			Chapters:    chapters,
+			CanEdit:     canEditVideo(r, meta),
+			Views:       views,
+			Playlist:    list,
+			MyPlaylists: userPlaylists(r),
 		}
 		renderTemplate(w, "vp", p)
 		return
 	}
-	sendError(w, r, "Invalid file name only allowed A-Z,a-z,0-9,-,_ or it'slonger than "+strconv.Itoa(AppConfig.MaxVideoNameLen)+" characters")
+	sendError(w, r, "Invalid video ID")
 }
 
 func deleteOLD() {
@@ -755,8 +1410,8 @@ func deleteOLD() {
 			// Delete old files in the upload path
 			go deleteOldFiles(AppConfig.UploadPath, AppConfig.DaysOld)
 
-			// Delete old files in the convert path
-			go deleteOldFiles(AppConfig.ConvertPath, AppConfig.DaysOld)
+			// Delete old videos of the library
+			go deleteOldVideos(AppConfig.DaysOld)
 		}
 	}()
 
@@ -793,6 +1448,27 @@ func deleteOldFiles(folderPath string, daysOld int) error {
 	return err
 }
 
+// deleteOldVideos removes the videos of the library uploaded more than daysOld days ago.
+func deleteOldVideos(daysOld int) {
+	var old []string
+	err := forEachVideo(func(videoname string, meta videoMeta) {
+		if !meta.Live && time.Since(meta.UploadedAt).Hours()/24 >= float64(daysOld) {
+			old = append(old, videoname)
+		}
+	})
+	if err != nil {
+		fmt.Println("Error listing old videos:", err)
+		return
+	}
+	for _, videoname := range old {
+		if err := deleteVideo(videoname); err != nil {
+			fmt.Println("Error deleting old video", videoname+":", err)
+			continue
+		}
+		fmt.Printf("Video %q deleted.\n", videoname)
+	}
+}
+
 func sendError(w http.ResponseWriter, r *http.Request, errormsg string) {
 	p := &PageErr{
 		ErrMsg: errormsg,
@@ -800,23 +1476,101 @@ func sendError(w http.ResponseWriter, r *http.Request, errormsg string) {
 	renderTemplate(w, "error", p)
 }
 
-func isSafeFileName(fileName string) bool {
-	return safeFileName.MatchString(fileName)
+// probeMedia uses ffprobe to find out which kind of streams the given file contains.
+func probeMedia(filePath string) (mediaInfo, error) {
+	var info mediaInfo
+	out, err := exec.Command("/usr/bin/ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", "-show_chapters", filePath).Output()
+	if err != nil {
+		return info, err
+	}
+	var probe struct {
+		Streams []struct {
+			CodecType   string `json:"codec_type"`
+			CodecName   string `json:"codec_name"`
+			Width       int    `json:"width"`
+			Height      int    `json:"height"`
+			FrameRate   string `json:"avg_frame_rate"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+		} `json:"format"`
+		Chapters []struct {
+			StartTime string `json:"start_time"`
+			Tags      struct {
+				Title string `json:"title"`
+			} `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return info, err
+	}
+	for _, stream := range probe.Streams {
+		if stream.CodecType != "video" && stream.CodecType != "audio" {
+			continue
+		}
+		if stream.CodecName != "" {
+			info.Decodable++
+			info.Codecs = append(info.Codecs, stream.CodecName)
+		}
+		switch stream.CodecType {
+		case "video":
+			// Cover art embedded in MP3/M4A files is reported as a video stream
+			if stream.Disposition.AttachedPic == 0 {
+				info.HasVideo = true
+				if stream.Width > info.Width {
+					info.Width = stream.Width
+				}
+				if stream.Height > info.Height {
+					info.Height = stream.Height
+				}
+				if fps := parseFrameRate(stream.FrameRate); fps > info.FrameRate {
+					info.FrameRate = fps
+				}
+			}
+		case "audio":
+			info.HasAudio = true
+		}
+	}
+	if probe.Format.FormatName != "" {
+		info.Formats = strings.Split(probe.Format.FormatName, ",")
+	}
+	for _, c := range probe.Chapters {
+		start, _ := strconv.ParseFloat(c.StartTime, 64)
+		info.Chapters = append(info.Chapters, chapter{Start: start, Title: c.Tags.Title})
+	}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	return info, nil
 }
 
-func resetVideoUploadedCounter() {
-	// Create an atomic integer to store the counter
-	var videosUploaded atomic.Int64
+// parseFrameRate converts a ffprobe frame rate such as "30000/1001" to frames per second.
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
 
-	// Start a goroutine to reset the counter every hour
-	go func() {
-		for range time.NewTicker(time.Hour).C {
-			videosUploaded.Store(0)
-		}
-	}()
+// isAudioOnly reports whether the converted video folder contains an audio only stream.
+func isAudioOnly(convertPath, videoName string) bool {
+	_, err := os.Stat(filepath.Join(convertPath, videoName, videoName+"audioonly.txt"))
+	return err == nil
+}
 
-	// Wait for the goroutine to finish
-	time.Sleep(time.Hour)
+func isSafeFileName(fileName string) bool {
+	return safeFileName.MatchString(fileName)
 }
 
 func ReadConfig() {
@@ -853,6 +1607,20 @@ func renderTemplate(w http.ResponseWriter, tmpl string, p interface{}) {
 		err = templateerr.ExecuteTemplate(w, tmpl+".html", p)
 	case *PageSndFile:
 		err = templatesndfile.ExecuteTemplate(w, tmpl+".html", p)
+	case *PageChapters:
+		err = templatechapters.ExecuteTemplate(w, tmpl+".html", p)
+	case *PageUploadSummary:
+		err = templateuplsummary.ExecuteTemplate(w, tmpl+".html", p)
+	case *PageEditVideo:
+		err = templateeditvideo.ExecuteTemplate(w, tmpl+".html", p)
+	case *PageSearch:
+		err = templatesearch.ExecuteTemplate(w, tmpl+".html", p)
+	case *PageTags:
+		err = templatetags.ExecuteTemplate(w, tmpl+".html", p)
+	case *PagePlaylists:
+		err = templateplaylists.ExecuteTemplate(w, tmpl+".html", p)
+	case *PagePlaylist:
+		err = templateplaylist.ExecuteTemplate(w, tmpl+".html", p)
 	}
 
 	if err != nil {
@@ -861,50 +1629,70 @@ func renderTemplate(w http.ResponseWriter, tmpl string, p interface{}) {
 	}
 }
 
-func (f folderInfos) Len() int {
-	return len(f)
-}
-
-func (f folderInfos) Less(i, j int) bool {
-	return f[i].ModTime.After(f[j].ModTime)
-}
-
-func (f folderInfos) Swap(i, j int) {
-	f[i], f[j] = f[j], f[i]
-}
-
-func listFolders(dirPath string, pageNum int) ([]folderInfo, error) {
-	files, err := ioutil.ReadDir(dirPath)
+// listFolders returns a page of the videos of the library for which visible returns true, the newest first,
+// and the number of visible videos.
+func listFolders(pageNum int, visible func(meta videoMeta) bool) ([]folderInfo, int, error) {
+	entries, total, err := listVideos((pageNum-1)*videosPerPage(), videosPerPage(), visible)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if len(entries) == 0 {
+		if total == 0 {
+			return nil, 0, fmt.Errorf("No video available.")
+		}
+		return nil, 0, fmt.Errorf("Invalid page number: %d", pageNum)
 	}
 
 	var infos []folderInfo
-	for _, file := range files {
-		if file.IsDir() {
-			info := folderInfo{
-				Name:    file.Name(),
-				ModTime: file.ModTime(),
-			}
-			infos = append(infos, info)
+	for _, entry := range entries {
+		info := folderInfo{
+			Name:       entry.ID,
+			Title:      entry.Meta.Title,
+			Tags:       entry.Meta.Tags,
+			UploadedAt: entry.Meta.UploadedAt,
+			Views:      entry.Views,
+			AudioOnly:  entry.Meta.AudioOnly,
+			Live:       entry.Meta.Live,
+		}
+		if info.Title == "" {
+			info.Title = info.Name
 		}
+		infos = append(infos, info)
 	}
+	return infos, total, nil
+}
 
-	sort.Sort(folderInfos(infos))
+// videosPerPage returns VideoPerPage, 10 if not set.
+func videosPerPage() int {
+	if AppConfig.VideoPerPage <= 0 {
+		return 10
+	}
+	return AppConfig.VideoPerPage
+}
 
-	startIndex := (pageNum - 1) * 10
-	if startIndex >= len(infos) {
-		if startIndex == 0 {
-			return nil, fmt.Errorf("No video available.")
-		}
-		return nil, fmt.Errorf("Invalid page number: %d", pageNum)
+// authenticatedUser returns the user logged in with the auth cookie.
+func authenticatedUser(r *http.Request) (User, bool) {
+	cookie, err := r.Cookie("auth")
+	if err != nil {
+		return User{}, false
 	}
-	endIndex := startIndex + 10
-	if endIndex > len(infos) {
-		endIndex = len(infos)
+	for i := 0; i < len(cookieKeys); i++ {
+		value, err := verifySignedCookieWithKey("auth", cookie.Value, cookieKeys[i])
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(value, "|")
+		if len(parts) != 2 {
+			return User{}, false
+		}
+		for _, user := range users {
+			if user.Username == parts[0] && user.Role == parts[1] {
+				return user, true
+			}
+		}
+		return User{}, false
 	}
-
-	return infos[startIndex:endIndex], nil
+	return User{}, false
 }
 
 func hasRoleWithKey(r *http.Request, role string, keyIndex int) bool {
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveOriginal moves the original uploaded file to ArchivePath/videoName, gzip compressed if ArchiveCompress is set.
+// It returns the path of the archived file.
+func archiveOriginal(filePath, videoName string) (string, error) {
+	dirPath := filepath.Join(AppConfig.ArchivePath, videoName)
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return "", err
+	}
+	archivePath := filepath.Join(dirPath, filepath.Base(filePath))
+
+	if !AppConfig.ArchiveCompress {
+		if err := os.Rename(filePath, archivePath); err == nil {
+			return archivePath, nil
+		}
+		// Rename fails across file systems, fallback to copy
+		if err := copyFile(filePath, archivePath, false); err != nil {
+			return "", err
+		}
+		return archivePath, os.Remove(filePath)
+	}
+
+	archivePath += ".gz"
+	if err := copyFile(filePath, archivePath, true); err != nil {
+		return "", err
+	}
+	return archivePath, os.Remove(filePath)
+}
+
+// copyFile copies src to dst, optionally gzip compressing it. A partial dst is removed on failure.
+func copyFile(src, dst string, compress bool) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	if !compress {
+		_, err = io.Copy(out, in)
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// restoreArchived extracts a compressed archived original to dirPath, it returns the path of the extracted file.
+func restoreArchived(archivePath, dirPath string) (string, error) {
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+
+	restoredPath := filepath.Join(dirPath, strings.TrimSuffix(filepath.Base(archivePath), ".gz"))
+	out, err := os.Create(restoredPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, gz); err != nil {
+		out.Close()
+		os.Remove(restoredPath)
+		return "", err
+	}
+	return restoredPath, out.Close()
+}
+
+// deleteOldArchives periodically removes the archived originals older than ArchiveDaysOld.
+func deleteOldArchives() {
+	for range time.NewTicker(checkOldEvery).C {
+		if AppConfig.ArchiveDaysOld <= 0 {
+			continue
+		}
+		folders, err := ioutil.ReadDir(AppConfig.ArchivePath)
+		if err != nil {
+			fmt.Println("Error reading archive folder:", err)
+			continue
+		}
+		for _, folder := range folders {
+			if time.Since(folder.ModTime()).Hours()/24 < float64(AppConfig.ArchiveDaysOld) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(AppConfig.ArchivePath, folder.Name())); err != nil {
+				fmt.Println("Error removing archived original:", err)
+				continue
+			}
+			fmt.Printf("Archived original %q deleted.\n", folder.Name())
+		}
+	}
+}
+
+// canDownloadOriginal reports whether the request comes from an admin or, if allowed, from the uploader of the video.
+func canDownloadOriginal(r *http.Request, meta videoMeta) bool {
+	if meta.ArchiveFile == "" || !canViewVideo(r, meta) {
+		return false
+	}
+	if adminAuthenticated(r) {
+		return true
+	}
+	if !AppConfig.AllowOriginalDownload || meta.Uploader == "" {
+		return false
+	}
+	user, ok := authenticatedUser(r)
+	return ok && user.Username == meta.Uploader
+}
+
+// downloadOriginalHandler sends the archived original of a video, decompressing it if needed.
+func downloadOriginalHandler(w http.ResponseWriter, r *http.Request) {
+	videoname := r.URL.Query().Get("videoname")
+	if !isSafeFileName(videoname) {
+		sendError(w, r, "Invalid video name")
+		return
+	}
+	meta, err := loadVideoMeta(videoname)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if !canDownloadOriginal(r, meta) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	f, err := os.Open(meta.ArchiveFile)
+	if err != nil {
+		sendError(w, r, "The original file is no longer available")
+		return
+	}
+	defer f.Close()
+
+	filename := meta.OriginalName
+	if filename == "" {
+		filename = strings.TrimSuffix(filepath.Base(meta.ArchiveFile), ".gz")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+strings.ReplaceAll(filename, "\"", "")+"\"")
+	if !strings.HasSuffix(meta.ArchiveFile, ".gz") {
+		info, err := f.Stat()
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		http.ServeContent(w, r, filename, info.ModTime(), f)
+		return
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	defer gz.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, gz); err != nil {
+		fmt.Println("Error sending original file:", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// uploadResult is the outcome of one of the files of an upload, shown in the summary page.
+type uploadResult struct {
+	FileName  string
+	VideoName string // set when the file has been queued for conversion
+	Err       string
+	abort     bool // the rest of the upload must not be read (size, name or rate limit violated)
+}
+
+// isUploadArchive reports whether an uploaded file is an archive whose videos have to be extracted.
+func isUploadArchive(filename string) bool {
+	name := strings.ToLower(filename)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// storeUpload streams one uploaded file to UploadPath and queues its conversion.
+// The name and the upload rate are checked before reading the data, a partial file is removed.
+func storeUpload(filename string, src io.Reader, role string, meta videoMeta) uploadResult {
+	result := uploadResult{FileName: filename, abort: true}
+	if err := checkUploadLimits(meta.Uploader, role); err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	filePath, err := newUploadPath(filename)
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	out, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	countUpload(meta.Uploader)
+
+	n, err := io.Copy(out, io.LimitReader(src, AppConfig.MaxUploadSize+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > AppConfig.MaxUploadSize {
+		err = errors.New("The uploaded file is too big: " + filename + ". Max size allowed: " + strconv.FormatInt(AppConfig.MaxUploadSize, 10))
+	}
+	if err == nil {
+		err = checkStorageQuota(meta.Uploader, role, n)
+	}
+	if err != nil {
+		if err := os.Remove(filePath); err != nil {
+			fmt.Println("error removing failed upload:", err)
+		}
+		result.Err = err.Error()
+		return result
+	}
+	result.abort = false
+
+	meta.OriginalName = filename
+	if meta.Title == "" {
+		meta.Title = videoTitle(filename)
+	}
+	if err := ingestFile(filePath, role, meta); err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	result.VideoName = videoIDFromFile(filePath)
+	return result
+}
+
+// storeUploadArchive extracts the files of an uploaded ZIP or TAR archive and stores each of them as an upload.
+// Directories and hidden files are skipped. A ZIP archive
+// needs random access, so it is first saved in UploadPath; a TAR archive is extracted while it is received.
+func storeUploadArchive(filename string, src io.Reader, role string, meta videoMeta) []uploadResult {
+	var results []uploadResult
+	aborted := false
+	store := func(name string, entry io.Reader) {
+		base := path.Base(name)
+		if aborted || strings.HasPrefix(base, ".") || strings.Contains(name, "__MACOSX/") {
+			return
+		}
+		result := storeUpload(base, entry, role, meta)
+		result.FileName = filename + ": " + name
+		aborted = result.abort
+		results = append(results, result)
+	}
+
+	if strings.HasSuffix(strings.ToLower(filename), ".zip") {
+		tmp, err := os.CreateTemp(AppConfig.UploadPath, ".archive-*.zip")
+		if err != nil {
+			return []uploadResult{{FileName: filename, Err: err.Error(), abort: true}}
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		size, err := io.Copy(tmp, io.LimitReader(src, AppConfig.MaxUploadSize+1))
+		if err == nil && size > AppConfig.MaxUploadSize {
+			err = errors.New("The uploaded file is too big: " + filename + ". Max size allowed: " + strconv.FormatInt(AppConfig.MaxUploadSize, 10))
+		}
+		if err != nil {
+			return []uploadResult{{FileName: filename, Err: err.Error(), abort: true}}
+		}
+		zr, err := zip.NewReader(tmp, size)
+		if err != nil {
+			return []uploadResult{{FileName: filename, Err: "Invalid ZIP archive: " + err.Error()}}
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				results = append(results, uploadResult{FileName: filename + ": " + f.Name, Err: err.Error()})
+				continue
+			}
+			store(f.Name, rc)
+			rc.Close()
+		}
+		return results
+	}
+
+	if name := strings.ToLower(filename); strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return []uploadResult{{FileName: filename, Err: "Invalid TAR archive: " + err.Error(), abort: true}}
+		}
+		defer gz.Close()
+		src = gz
+	}
+	tr := tar.NewReader(src)
+	for !aborted {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			results = append(results, uploadResult{FileName: filename, Err: "Invalid TAR archive: " + err.Error(), abort: true})
+			break
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			store(hdr.Name, tr)
+		}
+	}
+	return results
+}
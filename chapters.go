@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const chaptersFileName = "chapters.json"
+
+type chapter struct {
+	Start float64 `json:"start"` // seconds
+	Title string  `json:"title"`
+}
+
+// Timestamp returns the chapter start formatted as [H:]MM:SS for display.
+func (c chapter) Timestamp() string {
+	return formatTimestamp(c.Start)
+}
+
+// formatTimestamp formats seconds as mm:ss, or h:mm:ss from one hour.
+func formatTimestamp(seconds float64) string {
+	total := int(seconds)
+	h, m, s := total/3600, (total%3600)/60, total%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
+
+// loadChapters reads the chapters of a converted video, sorted by start time.
+func loadChapters(convertPath, videoName string) ([]chapter, error) {
+	var chapters []chapter
+	data, err := ioutil.ReadFile(filepath.Join(convertPath, videoName, chaptersFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &chapters); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	return chapters, nil
+}
+
+// saveChapters writes the chapters of a converted video, an empty list removes them.
+func saveChapters(convertPath, videoName string, chapters []chapter) error {
+	chaptersPath := filepath.Join(convertPath, videoName, chaptersFileName)
+	if len(chapters) == 0 {
+		if err := os.Remove(chaptersPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(chapters, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(chaptersPath, data, 0644)
+}
+
+// parseChapters parses one chapter per line in the form "[HH:]MM:SS[.mmm] Title".
+func parseChapters(text string) ([]chapter, error) {
+	var chapters []chapter
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		timestamp, title, _ := strings.Cut(line, " ")
+		start, err := parseTimestamp(timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		title = chapterTitle(strings.TrimLeft(title, " -"))
+		if title == "" {
+			return nil, fmt.Errorf("line %d: missing chapter title", i+1)
+		}
+		chapters = append(chapters, chapter{Start: start, Title: title})
+	}
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	return chapters, nil
+}
+
+// chapterTitle puts a title on one line: a line break in a WebVTT cue would end it or start another one.
+func chapterTitle(title string) string {
+	return strings.Join(strings.Fields(title), " ")
+}
+
+// parseTimestamp converts "[HH:]MM:SS[.mmm]" to seconds.
+func parseTimestamp(timestamp string) (float64, error) {
+	parts := strings.Split(timestamp, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q, expected [HH:]MM:SS", timestamp)
+	}
+	var seconds float64
+	for _, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q, expected [HH:]MM:SS", timestamp)
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+// formatVTTTime formats seconds as a WebVTT timestamp (HH:MM:SS.mmm).
+func formatVTTTime(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, (ms/60000)%60, (ms/1000)%60, ms%1000)
+}
+
+// chaptersVTTHandler serves the chapters of a video as a WebVTT chapters track.
+func chaptersVTTHandler(w http.ResponseWriter, r *http.Request) {
+	if AppConfig.VideoOnlyForUsers && !adminAuthenticated(r) && !userAuthenticated(r) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	videoname := r.URL.Query().Get("videoname")
+	if !isSafeFileName(videoname) {
+		http.Error(w, "Invalid video name", http.StatusBadRequest)
+		return
+	}
+	meta, _ := loadVideoMeta(videoname)
+	if !canViewVideo(r, meta) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	chapters, err := loadChapters(AppConfig.ConvertPath, videoname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+	for i, c := range chapters {
+		end := meta.Duration
+		if i+1 < len(chapters) {
+			end = chapters[i+1].Start
+		}
+		if end <= c.Start {
+			end = c.Start + 1
+		}
+		fmt.Fprintf(&sb, "%d\n%s --> %s\n%s\n\n", i+1, formatVTTTime(c.Start), formatVTTTime(end), strings.ReplaceAll(chapterTitle(c.Title), "-->", "->"))
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
+
+// editChaptersHandler shows and saves the chapters of a video, for its uploader and the admins.
+func editChaptersHandler(w http.ResponseWriter, r *http.Request) {
+	videoname := r.URL.Query().Get("videoname")
+	if !isSafeFileName(videoname) {
+		sendError(w, r, "Invalid video name")
+		return
+	}
+	meta, found, err := findVideo(videoname)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if !found {
+		sendError(w, r, "Video not found: "+videoname)
+		return
+	}
+	if !canEditVideo(r, meta) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	p := &PageChapters{VidNm: videoname}
+	if r.Method == http.MethodPost {
+		p.Text = r.FormValue("chapters")
+		chapters, err := parseChapters(p.Text)
+		if err == nil {
+			err = saveChapters(AppConfig.ConvertPath, videoname, chapters)
+		}
+		if err != nil {
+			p.ErrMsg = err.Error()
+			renderTemplate(w, "chapters", p)
+			return
+		}
+		http.Redirect(w, r, "/vp?videoname="+videoname, http.StatusSeeOther)
+		return
+	}
+
+	chapters, err := loadChapters(AppConfig.ConvertPath, videoname)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	var lines []string
+	for _, c := range chapters {
+		lines = append(lines, c.Timestamp()+" "+c.Title)
+	}
+	p.Text = strings.Join(lines, "\n")
+	p.Suggestions, err = loadSuggestedChapters(AppConfig.ConvertPath, videoname)
+	if err != nil {
+		fmt.Println(err)
+	}
+	p.CanDetect = !meta.AudioOnly && !meta.Live && !meta.Private
+	renderTemplate(w, "chapters", p)
+}
+
+// chaptersFromProbe converts the chapters found in the source container, untitled chapters are numbered.
+func chaptersFromProbe(probed []chapter) []chapter {
+	var chapters []chapter
+	for i, c := range probed {
+		c.Title = chapterTitle(c.Title)
+		if c.Title == "" {
+			c.Title = "Chapter " + strconv.Itoa(i+1)
+		}
+		chapters = append(chapters, c)
+	}
+	return chapters
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// Limits of the details of a video
+const (
+	maxDescriptionLen = 5000 // characters
+	maxTags           = 20
+	maxTagLen         = 30 // characters
+)
+
+// markdown renders the descriptions. Raw HTML is omitted and dangerous links (e.g. javascript:) are dropped,
+// as goldmark does unless html.WithUnsafe is set.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.Linkify, extension.Strikethrough))
+
+// setVideoDetails checks the title, the Markdown description and the comma separated tags entered by the
+// uploader and sets them in meta. An empty title is left empty, to be taken from the file name.
+func setVideoDetails(meta *videoMeta, title, description, tags string) error {
+	title = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, title))
+	if title != "" {
+		if err := checkVideoTitle(title); err != nil {
+			return err
+		}
+	}
+	description = strings.TrimSpace(strings.ReplaceAll(description, "\r\n", "\n"))
+	if !utf8.ValidString(description) || utf8.RuneCountInString(description) > maxDescriptionLen {
+		return errors.New("Invalid description: it must be valid text, not longer than " + strconv.Itoa(maxDescriptionLen) + " characters")
+	}
+	parsedTags, err := parseTags(tags)
+	if err != nil {
+		return err
+	}
+	meta.Title = title
+	meta.Description = description
+	meta.Tags = parsedTags
+	return nil
+}
+
+// parseTags splits comma separated tags. Tags are lower case, without duplicates.
+func parseTags(s string) ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.Join(strings.FieldsFunc(tag, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r)
+		}), " "))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !utf8.ValidString(tag) || utf8.RuneCountInString(tag) > maxTagLen {
+			return nil, errors.New("Invalid tag: tags must be valid text, not longer than " + strconv.Itoa(maxTagLen) + " characters")
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, errors.New("Too many tags, max " + strconv.Itoa(maxTags))
+	}
+	return tags, nil
+}
+
+// renderDescription converts a Markdown description to HTML.
+func renderDescription(description string) template.HTML {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(description), &buf); err != nil {
+		fmt.Println("Error rendering description:", err)
+		return template.HTML(template.HTMLEscapeString(description))
+	}
+	return template.HTML(buf.String())
+}
+
+// editVideoHandler shows and saves the title, description and tags of a video, for its uploader and the admins.
+func editVideoHandler(w http.ResponseWriter, r *http.Request) {
+	videoname := r.URL.Query().Get("videoname")
+	if !isSafeFileName(videoname) {
+		sendError(w, r, "Invalid video name")
+		return
+	}
+	meta, found, err := findVideo(videoname)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if !found {
+		sendError(w, r, "Video not found: "+videoname)
+		return
+	}
+	if !canEditVideo(r, meta) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	p := &PageEditVideo{
+		VidNm:       videoname,
+		Title:       meta.Title,
+		Description: meta.Description,
+		Tags:        strings.Join(meta.Tags, ", "),
+	}
+	if r.Method == http.MethodPost {
+		p.Title, p.Description, p.Tags = r.FormValue("title"), r.FormValue("description"), r.FormValue("tags")
+		err := setVideoDetails(&meta, p.Title, p.Description, p.Tags)
+		if err == nil && meta.Title == "" {
+			err = errors.New("The title can't be empty")
+		}
+		if err == nil {
+			err = saveVideoMeta(videoname, meta)
+		}
+		if err != nil {
+			p.ErrMsg = err.Error()
+			renderTemplate(w, "editvideo", p)
+			return
+		}
+		http.Redirect(w, r, "/vp?videoname="+videoname, http.StatusSeeOther)
+		return
+	}
+	renderTemplate(w, "editvideo", p)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// clearKeySystemID is the DASH-IF ClearKey system ID recognized by dash.js, commonPSSHSystemID is the
+// W3C common PSSH box written by MP4Box.
+const (
+	clearKeySystemID   = "e2719d58-a985-b3c9-781a-b030af78d30e"
+	commonPSSHSystemID = "1077efec-c0b2-4d02-ace3-3c1e52e2fb4b"
+)
+
+var adaptationSetTag = regexp.MustCompile(`<AdaptationSet[^>]*>`)
+
+// contentKey is the CENC key of an encrypted video, stored in KeyPath and never in the served folders.
+type contentKey struct {
+	KID string `json:"kid"` // 16 bytes, hex
+	Key string `json:"key"` // 16 bytes, hex
+}
+
+// keyDir returns the folder of the content keys.
+func keyDir() string {
+	if AppConfig.KeyPath == "" {
+		return "./keys"
+	}
+	return AppConfig.KeyPath
+}
+
+func contentKeyPath(videoName string) string {
+	return filepath.Join(keyDir(), videoName+".json")
+}
+
+// loadContentKey reads the key of a video, ok is false if the video is not encrypted.
+func loadContentKey(videoName string) (key contentKey, ok bool, err error) {
+	data, err := ioutil.ReadFile(contentKeyPath(videoName))
+	if os.IsNotExist(err) {
+		return key, false, nil
+	}
+	if err != nil {
+		return key, false, err
+	}
+	err = json.Unmarshal(data, &key)
+	return key, err == nil, err
+}
+
+// loadOrCreateContentKey returns the key of a video, generating it the first time. Re-transcoded videos keep their key.
+func loadOrCreateContentKey(videoName string) (contentKey, error) {
+	key, ok, err := loadContentKey(videoName)
+	if ok || err != nil {
+		return key, err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return key, err
+	}
+	key = contentKey{KID: hex.EncodeToString(random[:16]), Key: hex.EncodeToString(random[16:])}
+	data, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return key, err
+	}
+	if err := os.MkdirAll(keyDir(), 0700); err != nil {
+		return key, err
+	}
+	return key, ioutil.WriteFile(contentKeyPath(videoName), data, 0600)
+}
+
+// deleteContentKey removes the key of a deleted video.
+func deleteContentKey(videoName string) {
+	if err := os.Remove(contentKeyPath(videoName)); err != nil && !os.IsNotExist(err) {
+		fmt.Println("error removing content key:", err)
+	}
+}
+
+// decryptionArgs returns the ffmpeg input options needed to read the renditions of a video, if encrypted.
+func decryptionArgs(videoName string) []string {
+	key, ok, err := loadContentKey(videoName)
+	if err != nil {
+		fmt.Println("Error reading content key:", err)
+	}
+	if !ok {
+		return nil
+	}
+	return []string{"-decryption_key", key.Key}
+}
+
+// writeDRMFile writes the MP4Box encryption file (CENC AES-CTR, same key for every track) for a key.
+// It lives in KeyPath because it contains the key.
+func writeDRMFile(videoName string, key contentKey) (string, error) {
+	iv := make([]byte, 8)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	drm := `<?xml version="1.0" encoding="UTF-8"?>
+<GPACDRM type="CENC AES-CTR">
+  <DRMInfo type="pssh" version="1">
+    <BS ID128="` + strings.ReplaceAll(commonPSSHSystemID, "-", "") + `"/>
+    <BS bits="32" value="1"/>
+    <BS ID128="` + key.KID + `"/>
+  </DRMInfo>
+  <CrypTrack IsEncrypted="1" IV_size="8" first_IV="0x` + hex.EncodeToString(iv) + `" saiSavedBox="senc">
+    <key KID="0x` + key.KID + `" value="0x` + key.Key + `"/>
+  </CrypTrack>
+</GPACDRM>
+`
+	if err := os.MkdirAll(keyDir(), 0700); err != nil {
+		return "", err
+	}
+	drmPath := filepath.Join(keyDir(), videoName+".drm.xml")
+	return drmPath, ioutil.WriteFile(drmPath, []byte(drm), 0600)
+}
+
+// encryptRenditions encrypts in place the renditions of a video found in files, with the key of the video.
+func encryptRenditions(ctx context.Context, videoName string, files []string) (contentKey, error) {
+	key, err := loadOrCreateContentKey(videoName)
+	if err != nil {
+		return key, err
+	}
+	drmPath, err := writeDRMFile(videoName, key)
+	defer os.Remove(drmPath)
+	if err != nil {
+		return key, err
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			continue
+		}
+		encrypted := strings.TrimSuffix(f, ".mp4") + "_enc.mp4"
+		if err := runConvCommand(ctx, newConvCommand(ctx, "MP4Box", "-crypt", drmPath, f, "-out", encrypted)); err != nil {
+			os.Remove(encrypted)
+			return key, fmt.Errorf("encrypting %s: %w", filepath.Base(f), err)
+		}
+		if err := os.Rename(encrypted, f); err != nil {
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+// addClearKeyProtection makes sure every AdaptationSet of an encrypted MPD carries the cenc and ClearKey
+// ContentProtection elements dash.js looks for, pointing to the license endpoint.
+func addClearKeyProtection(mpdPath, videoName string, key contentKey) error {
+	data, err := ioutil.ReadFile(mpdPath)
+	if err != nil {
+		return err
+	}
+	mpd := string(data)
+	var elements string
+	if !strings.Contains(mpd, "urn:mpeg:dash:mp4protection:2011") {
+		elements += `<ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc" cenc:default_KID="` + kidUUID(key.KID) + `"/>`
+	}
+	elements += `<ContentProtection schemeIdUri="urn:uuid:` + clearKeySystemID + `" value="ClearKey1.0"><clearkey:Laurl Lic_type="EME-1.0">/license?videoname=` + videoName + `</clearkey:Laurl></ContentProtection>`
+	mpd = adaptationSetTag.ReplaceAllStringFunc(mpd, func(tag string) string {
+		return tag + "\n   " + elements
+	})
+	for prefix, ns := range map[string]string{"cenc": "urn:mpeg:cenc:2013", "clearkey": "http://dashif.org/guidelines/clearKey"} {
+		if !strings.Contains(mpd, "xmlns:"+prefix+"=") {
+			mpd = strings.Replace(mpd, "<MPD ", `<MPD xmlns:`+prefix+`="`+ns+`" `, 1)
+		}
+	}
+	tmpPath := mpdPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(mpd), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, mpdPath)
+}
+
+// kidUUID formats a hex key ID as UUID, as used by cenc:default_KID.
+func kidUUID(kid string) string {
+	if len(kid) != 32 {
+		return kid
+	}
+	return kid[:8] + "-" + kid[8:12] + "-" + kid[12:16] + "-" + kid[16:20] + "-" + kid[20:]
+}
+
+// canViewVideo reports whether the request can watch a video: private videos only for their uploader and the admins.
+func canViewVideo(r *http.Request, meta videoMeta) bool {
+	if meta.Private {
+		return canEditVideo(r, meta)
+	}
+	return !AppConfig.VideoOnlyForUsers || adminAuthenticated(r) || userAuthenticated(r)
+}
+
+// licenseHandler is the ClearKey license server: it answers the EME license request of dash.js with the key
+// of the video, only to the viewers allowed to watch it.
+func licenseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	videoname := r.URL.Query().Get("videoname")
+	if !isSafeFileName(videoname) {
+		http.Error(w, "Invalid video name", http.StatusBadRequest)
+		return
+	}
+	meta, err := loadVideoMeta(videoname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !canViewVideo(r, meta) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	key, ok, err := loadContentKey(videoname)
+	if err != nil || !ok {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		KIDs []string `json:"kids"`
+		Type string   `json:"type"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+		http.Error(w, "Invalid license request", http.StatusBadRequest)
+		return
+	}
+	kid, err := hex.DecodeString(key.KID)
+	if err != nil {
+		http.Error(w, "Invalid key", http.StatusInternalServerError)
+		return
+	}
+	value, err := hex.DecodeString(key.Key)
+	if err != nil {
+		http.Error(w, "Invalid key", http.StatusInternalServerError)
+		return
+	}
+	encodedKID := base64.RawURLEncoding.EncodeToString(kid)
+	found := false
+	for _, requested := range request.KIDs {
+		if strings.TrimRight(requested, "=") == encodedKID {
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, "Unknown key ID", http.StatusNotFound)
+		return
+	}
+
+	type jwk struct {
+		Kty string `json:"kty"`
+		K   string `json:"k"`
+		Kid string `json:"kid"`
+	}
+	response := struct {
+		Keys []jwk  `json:"keys"`
+		Type string `json:"type"`
+	}{
+		Keys: []jwk{{Kty: "oct", K: base64.RawURLEncoding.EncodeToString(value), Kid: encodedKID}},
+		Type: "temporary",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("error sending license:", err)
+	}
+}
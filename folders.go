@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// swapVideoFolder replaces the folder of the renditions of a video with newPath, a folder on the same
+// file system. Where the system can exchange two folders with a single rename (Linux), /converted/<name>
+// never disappears for the players; otherwise the old folder is moved aside for a moment.
+func swapVideoFolder(currentPath, newPath string) error {
+	err := exchangeFolders(newPath, currentPath)
+	if err == nil {
+		// newPath holds the old renditions now
+		return os.RemoveAll(newPath)
+	}
+	if !errors.Is(err, errors.ErrUnsupported) && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOSYS) {
+		return err
+	}
+
+	oldPath := filepath.Join(AppConfig.ConvertPath, retranscodeDir+"-old", filepath.Base(currentPath))
+	if err := os.MkdirAll(filepath.Dir(oldPath), 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(oldPath); err != nil {
+		return err
+	}
+	if err := os.Rename(currentPath, oldPath); err != nil {
+		return err
+	}
+	if err := os.Rename(newPath, currentPath); err != nil {
+		if rollbackErr := os.Rename(oldPath, currentPath); rollbackErr != nil {
+			return fmt.Errorf("%v, and moving the old renditions back failed: %v (they are in %s)", err, rollbackErr, oldPath)
+		}
+		return err
+	}
+	return os.RemoveAll(oldPath)
+}
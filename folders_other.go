@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// exchangeFolders is not available, swapVideoFolder moves the folders one after the other.
+func exchangeFolders(a, b string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapVideoFolder(t *testing.T) {
+	saved := AppConfig
+	t.Cleanup(func() { AppConfig = saved })
+	AppConfig.ConvertPath = t.TempDir()
+	currentPath := filepath.Join(AppConfig.ConvertPath, "video000001")
+	newPath := filepath.Join(AppConfig.ConvertPath, retranscodeDir, "video000001")
+	for dir, content := range map[string]string{currentPath: "old", newPath: "new"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "output.mpd"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := swapVideoFolder(currentPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(currentPath)
+	if err != nil || !info.IsDir() {
+		t.Fatalf("%s is not a folder after the swap: %v", currentPath, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(currentPath, "output.mpd")); string(data) != "new" {
+		t.Errorf("served renditions are %q, want the new ones", data)
+	}
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		t.Errorf("the old renditions are left in %s", newPath)
+	}
+}
@@ -3,6 +3,9 @@ module gotube
 go 1.24.0
 
 require (
+	github.com/yuin/goldmark v1.8.2
+	go.etcd.io/bbolt v1.4.3
 	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errImportRejected marks the import errors that retrying can't fix.
+var errImportRejected = errors.New("import rejected")
+
+// importURLHandler downloads a video from a remote URL in background and converts it like an upload.
+func importURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !AppConfig.EnableURLImport {
+		sendError(w, r, "Import from URL is disabled")
+		return
+	}
+	if !canUpload(w, r) {
+		return
+	}
+	if err := checkUploadLimits(requestUsername(r), requestRole(r)); err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	u, err := checkImportURL(strings.TrimSpace(r.FormValue("url")))
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	// The optional name is the title of the video, the extension comes from the URL
+	filename := path.Base(u.Path)
+	if title := strings.TrimSpace(r.FormValue("name")); title != "" {
+		filename = title + path.Ext(u.Path)
+	}
+	filePath, err := newUploadPath(filename)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	// Create the file now so that the name is reserved while downloading
+	out, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	countUpload(requestUsername(r))
+
+	meta := newVideoMeta(requestUsername(r), filename)
+	meta.Private = AppConfig.AllowPrivateVideos && meta.Uploader != "" && r.FormValue("private") != ""
+	go importURL(u, out, requestRole(r), meta)
+
+	p := &PageUploaded{
+		FileName:   filename,
+		VideoName:  videoIDFromFile(filePath),
+		QuequeSize: int(quequelen.Load()),
+		Importing:  true,
+	}
+	renderTemplate(w, "uploaded", p)
+}
+
+// importURL downloads u into out, then validates and converts the file. A failed download is removed.
+func importURL(u *url.URL, out *os.File, role string, meta videoMeta) {
+	filePath := out.Name()
+	fmt.Println("Import start:", u.Redacted())
+	setProgressStage(videoIDFromFile(filePath), stageDownloading, "")
+	err := downloadURL(appCtx, u, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Println("Import of", u.Redacted(), "failed:", err)
+		if err := os.Remove(filePath); err != nil {
+			fmt.Println("error removing failed import:", err)
+		}
+		setProgressStage(videoIDFromFile(filePath), stageFailed, "Download failed")
+		return
+	}
+	fmt.Println("Import end:", u.Redacted())
+	if err := ingestFile(filePath, role, meta); err != nil {
+		fmt.Println("Import of", u.Redacted(), "failed:", err)
+	}
+}
+
+// downloadURL copies the content of u into out, resuming with range requests when the connection drops.
+func downloadURL(ctx context.Context, u *url.URL, out *os.File) error {
+	client := importClient()
+	var written int64
+	var err error
+	for attempt := 0; attempt <= AppConfig.ImportRetries; attempt++ {
+		if attempt > 0 {
+			fmt.Println("Import of", u.Redacted(), "interrupted at", written, "bytes, retrying:", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * 2 * time.Second):
+			}
+		}
+		err = downloadAttempt(ctx, client, u, out, &written)
+		if err == nil || errors.Is(err, errImportRejected) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// downloadAttempt sends one request for the bytes of u after *written and appends them to out.
+func downloadAttempt(ctx context.Context, client *http.Client, u *url.URL, out *os.File, written *int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errImportRejected, err)
+	}
+	if *written > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(*written, 10)+"-")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var total int64 = -1
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && *written > 0:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != *written {
+			return fmt.Errorf("%w: invalid Content-Range %q", errImportRejected, resp.Header.Get("Content-Range"))
+		}
+		total = size
+	case resp.StatusCode == http.StatusOK:
+		// The server doesn't support ranges, start again
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := out.Truncate(0); err != nil {
+			return err
+		}
+		*written = 0
+		total = resp.ContentLength
+	case resp.StatusCode >= 500:
+		return errors.New("server error: " + resp.Status)
+	default:
+		return fmt.Errorf("%w: unexpected response %s", errImportRejected, resp.Status)
+	}
+
+	if err := checkImportContentType(resp.Header.Get("Content-Type")); err != nil {
+		return err
+	}
+	if total > AppConfig.MaxUploadSize {
+		return fmt.Errorf("%w: the file is too big (%d bytes), max size allowed: %d", errImportRejected, total, AppConfig.MaxUploadSize)
+	}
+
+	n, err := io.Copy(out, io.LimitReader(resp.Body, AppConfig.MaxUploadSize-*written+1))
+	*written += n
+	if *written > AppConfig.MaxUploadSize {
+		return fmt.Errorf("%w: the file is bigger than the max size allowed: %d", errImportRejected, AppConfig.MaxUploadSize)
+	}
+	if err != nil {
+		return err
+	}
+	if total >= 0 && *written < total {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// parseContentRange returns the first byte and the complete size (-1 if unknown) of a
+// "bytes first-last/size" Content-Range header.
+func parseContentRange(contentRange string) (int64, int64, bool) {
+	rangeSpec, size, found := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "/")
+	first, _, _ := strings.Cut(rangeSpec, "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if !found || err != nil {
+		return 0, 0, false
+	}
+	if size == "*" {
+		return start, -1, true
+	}
+	total, err := strconv.ParseInt(size, 10, 64)
+	return start, total, err == nil
+}
+
+// checkImportContentType accepts only video, audio and generic binary content.
+func checkImportContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: invalid content type %q", errImportRejected, contentType)
+	}
+	if strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") || mediaType == "application/octet-stream" {
+		return nil
+	}
+	return fmt.Errorf("%w: content type %s is not a video or audio file", errImportRejected, mediaType)
+}
+
+// checkImportURL parses an import URL and checks its scheme and host.
+func checkImportURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, errors.New("Invalid URL: " + rawURL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("Only http and https URLs can be imported")
+	}
+	if !importHostAllowed(u.Hostname()) {
+		return nil, errors.New("Import from " + u.Hostname() + " is not allowed")
+	}
+	return u, nil
+}
+
+// importHostAllowed checks a host against ImportDenyHosts and, if set, ImportAllowHosts.
+// An entry matches the host itself and its subdomains.
+func importHostAllowed(host string) bool {
+	if hostInList(host, AppConfig.ImportDenyHosts) {
+		return false
+	}
+	return strings.TrimSpace(AppConfig.ImportAllowHosts) == "" || hostInList(host, AppConfig.ImportAllowHosts)
+}
+
+// hostInList reports whether host is, or is a subdomain of, one of the comma separated hosts in list.
+func hostInList(host, list string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" && (host == entry || strings.HasSuffix(host, "."+entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// importClient returns the HTTP client used for the imports. It connects only to public addresses
+// (unless ImportAllowPrivate is set), checking the resolved IP so that DNS can't be used to reach
+// internal services, and it checks the host of every redirect.
+func importClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || (!AppConfig.ImportAllowPrivate && isInternalIP(ip)) {
+				return fmt.Errorf("%w: connection to %s is not allowed", errImportRejected, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("%w: too many redirects", errImportRejected)
+			}
+			if _, err := checkImportURL(req.URL.String()); err != nil {
+				return fmt.Errorf("%w: %v", errImportRejected, err)
+			}
+			return nil
+		},
+	}
+}
+
+// isInternalIP reports whether ip is a loopback, private, link-local, multicast or unspecified address.
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// setImportConfig sets the import options for a test, the local test server is allowed when allowPrivate is set.
+func setImportConfig(t *testing.T, maxSize int64, allowPrivate bool) {
+	t.Helper()
+	saved := AppConfig
+	t.Cleanup(func() { AppConfig = saved })
+	AppConfig.MaxUploadSize = maxSize
+	AppConfig.ImportRetries = 2
+	AppConfig.ImportAllowPrivate = allowPrivate
+	AppConfig.ImportAllowHosts = ""
+	AppConfig.ImportDenyHosts = ""
+}
+
+// download runs downloadURL from the test server into a temporary file and returns its content.
+func download(t *testing.T, serverURL string) ([]byte, error) {
+	t.Helper()
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.CreateTemp(t.TempDir(), "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	err = downloadURL(context.Background(), u, out)
+	data, readErr := os.ReadFile(out.Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return data, err
+}
+
+func TestDownloadURLResumesWithRange(t *testing.T) {
+	setImportConfig(t, 1<<20, true)
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	half := len(payload) / 2
+	var ranges []string
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		if requests.Add(1) == 1 {
+			// Drop the connection in the middle of the body
+			w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+			w.Write(payload[:half])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err != nil || start > len(payload) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(payload)-1, len(payload)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[start:])
+	}))
+	defer server.Close()
+
+	data, err := download(t, server.URL)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("downloaded %d bytes, want the %d bytes of the payload", len(data), len(payload))
+	}
+	if want := "bytes=" + strconv.Itoa(half) + "-"; len(ranges) != 1 || ranges[0] != want {
+		t.Fatalf("Range headers %q, want [%q]", ranges, want)
+	}
+}
+
+func TestDownloadURLRejectsTooBig(t *testing.T) {
+	setImportConfig(t, 1000, true)
+	for _, sendLength := range []bool{true, false} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "video/mp4")
+			if sendLength {
+				w.Header().Set("Content-Length", "2000")
+			} else {
+				w.(http.Flusher).Flush() // chunked, the size is found while copying
+			}
+			w.Write(make([]byte, 2000))
+		}))
+		_, err := download(t, server.URL)
+		server.Close()
+		if !errors.Is(err, errImportRejected) {
+			t.Fatalf("with Content-Length %v: got %v, want a rejection", sendLength, err)
+		}
+	}
+}
+
+func TestDownloadURLRejectsContentType(t *testing.T) {
+	setImportConfig(t, 1<<20, true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	data, err := download(t, server.URL)
+	if !errors.Is(err, errImportRejected) {
+		t.Fatalf("got %v, want a rejection", err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d bytes written for a rejected file", len(data))
+	}
+}
+
+func TestDownloadURLBlocksPrivateAddresses(t *testing.T) {
+	setImportConfig(t, 1<<20, false)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("video"))
+	}))
+	defer server.Close()
+
+	_, err := download(t, server.URL)
+	if !errors.Is(err, errImportRejected) {
+		t.Fatalf("got %v, want a rejection of the loopback address", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("the server got %d requests", n)
+	}
+}
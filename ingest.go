@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var safeExtension = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// canUpload checks the upload permissions, redirecting to the login page when they are missing.
+func canUpload(w http.ResponseWriter, r *http.Request) bool {
+	if !uploadAllowed(r) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return false
+	}
+	return true
+}
+
+// uploadAllowed reports whether the request can upload videos.
+func uploadAllowed(r *http.Request) bool {
+	if AppConfig.AllowUploadOnlyFromAdmins && !adminAuthenticated(r) {
+		return false
+	}
+	if AppConfig.AllowUploadOnlyFromUsers && !adminAuthenticated(r) && !userAuthenticated(r) {
+		return false
+	}
+	return true
+}
+
+// newUploadPath checks the name of an uploaded file and returns the path where it has to be stored in UploadPath.
+// The file is named after a new video ID, the name only gives the title of the video (see videoTitle).
+func newUploadPath(filename string) (string, error) {
+	if err := checkVideoTitle(videoTitle(filename)); err != nil {
+		return "", err
+	}
+	id, err := newVideoID()
+	if err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if !safeExtension.MatchString(ext) {
+		ext = ""
+	}
+	return filepath.Join(AppConfig.UploadPath, id+ext), nil
+}
+
+// maxVideoIDLen is the longest video ID, the name of its folder in ConvertPath. The generated IDs have
+// 12 characters, the ones of older versions (file names) and of the live streams (MaxVideoNameLen) can be longer.
+const maxVideoIDLen = 255
+
+// isValidVideoID reports whether id can be the ID of a video.
+func isValidVideoID(id string) bool {
+	return len(id) <= maxVideoIDLen && isSafeFileName(id)
+}
+
+// newVideoID returns a random URL-safe ID, not used by any converted video or pending upload.
+// The IDs of the videos uploaded by older versions are their sanitized file names, see importVideoFolders.
+func newVideoID() (string, error) {
+	random := make([]byte, 9)
+	for {
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		id := base64.RawURLEncoding.EncodeToString(random)
+		if strings.HasPrefix(id, "-") {
+			continue // not to be taken for an option by the retranscode command
+		}
+		if _, err := os.Stat(filepath.Join(AppConfig.ConvertPath, id)); !os.IsNotExist(err) {
+			continue
+		}
+		if _, found, _ := findVideo(id); found {
+			continue
+		}
+		if matches, _ := filepath.Glob(filepath.Join(AppConfig.UploadPath, id+".*")); len(matches) > 0 {
+			continue
+		}
+		return id, nil
+	}
+}
+
+// videoIDFromFile returns the ID of the video converted from the given file of UploadPath.
+func videoIDFromFile(filePath string) string {
+	filename := filepath.Base(filePath)
+	return strings.TrimSuffix(filename, filepath.Ext(filename))
+}
+
+// videoTitle returns the title of a video from the name of its file: no extension and no control characters.
+func videoTitle(filename string) string {
+	title := strings.TrimSuffix(filename, filepath.Ext(filename))
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, title)
+	return strings.TrimSpace(title)
+}
+
+// checkVideoTitle checks that a title is valid UTF-8, not empty and not longer than MaxTitleLen characters (100 if not set).
+func checkVideoTitle(title string) error {
+	maxLen := AppConfig.MaxTitleLen
+	if maxLen <= 0 {
+		maxLen = 100
+	}
+	if title == "" || !utf8.ValidString(title) || utf8.RuneCountInString(title) > maxLen {
+		return errors.New("Invalid title: it must be valid text, not longer than " + strconv.Itoa(maxLen) + " characters")
+	}
+	return nil
+}
+
+// ingestFile scans and validates a file stored in UploadPath and queues its conversion with the given metadata.
+// A rejected file is removed (or quarantined if infected) and the returned error tells why.
+func ingestFile(filePath, role string, meta videoMeta) error {
+	// The videos without uploader imported from older versions or from the watch folder are not the guests'
+	meta.GuestUpload = meta.Uploader == "" && role == "guest"
+	if err := scanUpload(filePath, meta); err != nil {
+		if _, statErr := os.Stat(filePath); statErr == nil {
+			if err := os.Remove(filePath); err != nil {
+				fmt.Println("error removing rejected upload:", err)
+			}
+		}
+		setProgressStage(videoIDFromFile(filePath), stageFailed, "File rejected: "+err.Error())
+		return fmt.Errorf("File rejected: %w", err)
+	}
+	// Reject non media files and files out of the upload policy before queueing them
+	if err := validateUpload(filePath, meta.Uploader, role); err != nil {
+		if err := os.Remove(filePath); err != nil {
+			fmt.Println("error removing rejected upload:", err)
+		}
+		setProgressStage(videoIDFromFile(filePath), stageFailed, "File rejected: "+err.Error())
+		return fmt.Errorf("File rejected: %w", err)
+	}
+	go StartconvertVideo(filePath, AppConfig.ConvertPath, videoIDFromFile(filePath), meta)
+	return nil
+}
+
+// newVideoMeta returns the metadata of a video being uploaded now, titled after its file name.
+func newVideoMeta(uploader, originalName string) videoMeta {
+	return videoMeta{
+		Title:        videoTitle(originalName),
+		Uploader:     uploader,
+		OriginalName: originalName,
+		UploadedAt:   time.Now(),
+	}
+}
+
+// requestUsername returns the name of the logged in user, empty for guests.
+func requestUsername(r *http.Request) string {
+	if user, ok := authenticatedUser(r); ok {
+		return user.Username
+	}
+	return ""
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	liveStreams   = make(map[string]string) // stream name -> username of the broadcaster
+	liveStreamsMu sync.Mutex
+)
+
+// liveIngestHandler receives a live stream pushed by an encoder (OBS, ffmpeg...) as an
+// MPEG-TS request body (POST or PUT) and transcodes it in real time into a dynamic DASH manifest.
+// Example: ffmpeg -re -i input.mp4 -c copy -f mpegts "http://host:8085/live/ingest?key=<streamkey>&name=<streamname>"
+func liveIngestHandler(w http.ResponseWriter, r *http.Request) {
+	if !AppConfig.EnableLive {
+		http.Error(w, "Live streaming is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	broadcaster, ok := userByStreamKey(key)
+	if !ok {
+		http.Error(w, "Invalid stream key", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if len(name) > AppConfig.MaxVideoNameLen || !isSafeFileName(name) {
+		http.Error(w, "Invalid stream name: either it contains invalid characters or it's longer than "+strconv.Itoa(AppConfig.MaxVideoNameLen)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	liveStreamsMu.Lock()
+	if _, busy := liveStreams[name]; busy {
+		liveStreamsMu.Unlock()
+		http.Error(w, "Stream already running: "+name, http.StatusConflict)
+		return
+	}
+	liveStreams[name] = broadcaster.Username
+	liveStreamsMu.Unlock()
+	defer func() {
+		liveStreamsMu.Lock()
+		delete(liveStreams, name)
+		liveStreamsMu.Unlock()
+	}()
+
+	dirPath := filepath.Join(AppConfig.ConvertPath, name)
+	if err := os.Mkdir(filepath.Clean(dirPath), 0755); err != nil {
+		http.Error(w, "Stream name already in use: "+name, http.StatusConflict)
+		return
+	}
+	liveFilePath := filepath.Join(dirPath, name+"live.txt")
+	if file, err := os.Create(filepath.Clean(liveFilePath)); err == nil {
+		file.Close()
+	}
+	err := saveVideoMeta(name, videoMeta{Title: name, Uploader: broadcaster.Username, UploadedAt: time.Now(), Live: true})
+	if err != nil {
+		fmt.Println("error saving live stream:", err)
+	}
+
+	archivePath := ""
+	if AppConfig.LiveArchive {
+		archivePath = filepath.Join(AppConfig.UploadPath, name+"_live.ts")
+	}
+
+	fmt.Println("Live stream started:", name, "by", broadcaster.Username)
+	// The audio track is optional, the start of the stream is probed to know whether there is one
+	head := make([]byte, liveProbeSize)
+	n, _ := io.ReadFull(r.Body, head)
+	head = head[:n]
+	cmd := newCommand(appCtx, "/usr/bin/ffmpeg", liveFFmpegArgs(dirPath, archivePath, probeLiveAudio(head))...)
+	cmd.Stdin = io.MultiReader(bytes.NewReader(head), r.Body)
+	err = runConvCommand(appCtx, cmd)
+	if err != nil {
+		fmt.Println("Live stream", name, "ended with error:", err)
+	} else {
+		fmt.Println("Live stream ended:", name)
+	}
+
+	// The dynamic manifest is useless once the stream is over
+	if err := os.RemoveAll(dirPath); err != nil {
+		fmt.Println("error removing live folder:", err)
+	}
+	if err := deleteVideoRecord(name); err != nil {
+		fmt.Println("error removing live stream:", err)
+	}
+	if archivePath != "" {
+		if _, err := os.Stat(archivePath); err == nil {
+			if err := archiveLiveStream(name, archivePath, broadcaster); err != nil {
+				fmt.Println("Archive of live stream", name, "dropped:", err)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// archiveLiveStream ingests the recording of an ended live stream like an upload of the broadcaster: it is
+// checked against the limits and the quota, scanned and validated, and dropped if rejected.
+func archiveLiveStream(name, archivePath string, broadcaster User) error {
+	err := checkUploadLimits(broadcaster.Username, broadcaster.Role)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(archivePath); err == nil {
+			err = checkStorageQuota(broadcaster.Username, broadcaster.Role, info.Size())
+		}
+	}
+	if err != nil {
+		os.Remove(archivePath)
+		return err
+	}
+	// The video keeps the name of the stream
+	filePath := filepath.Join(AppConfig.UploadPath, name+filepath.Ext(archivePath))
+	if err := os.Rename(archivePath, filePath); err != nil {
+		os.Remove(archivePath)
+		return err
+	}
+	countUpload(broadcaster.Username)
+	meta := videoMeta{
+		Title:        name,
+		Uploader:     broadcaster.Username,
+		OriginalName: filepath.Base(archivePath),
+		UploadedAt:   time.Now(),
+	}
+	return ingestFile(filePath, broadcaster.Role, meta)
+}
+
+// liveProbeSize is the size of the start of an ingested stream probed by probeLiveAudio.
+const liveProbeSize = 1 << 20
+
+// probeLiveAudio reports whether the start of an ingested stream has an audio track.
+// If it can't be probed, the stream is assumed to have one.
+func probeLiveAudio(head []byte) bool {
+	cmd := newCommand(appCtx, "/usr/bin/ffprobe", "-v", "error", "-select_streams", "a", "-show_entries", "stream=codec_type", "-of", "csv=p=0", "-i", "pipe:0")
+	cmd.Stdin = bytes.NewReader(head)
+	out, err := cmd.Output()
+	if err != nil {
+		fmt.Println("Error probing live stream:", err)
+		return true
+	}
+	return len(bytes.TrimSpace(out)) > 0
+}
+
+// liveFFmpegArgs builds the ffmpeg arguments used to transcode the ingested stream to the rendition ladder.
+// Without audio track the manifest has only the video adaptation set, as the dash muxer fails on an empty one.
+func liveFFmpegArgs(dirPath, archivePath string, hasAudio bool) []string {
+	segDuration := AppConfig.LiveSegDuration
+	if segDuration == "" {
+		segDuration = "2"
+	}
+	windowSize := AppConfig.LiveWindowSize
+	if windowSize <= 0 {
+		windowSize = 10
+	}
+	args := []string{"-i", "pipe:0", "-map_metadata", "-1"}
+	renditions := []struct{ res, bitrate string }{
+		{AppConfig.VideoResHigh, AppConfig.BitRateHigh},
+		{AppConfig.VideoResMed, AppConfig.BitRateMed},
+		{AppConfig.VideoResLow, AppConfig.BitRateLow},
+	}
+	for range renditions {
+		args = append(args, "-map", "0:v:0")
+	}
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+	for i, rendition := range renditions {
+		idx := strconv.Itoa(i)
+		args = append(args, "-filter:v:"+idx, "scale="+rendition.res+":-2", "-b:v:"+idx, rendition.bitrate)
+	}
+	args = append(args,
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-threads", AppConfig.NrOfCoreVideoConv,
+		"-g", "60", "-keyint_min", "60", "-sc_threshold", "0",
+	)
+	if hasAudio {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args,
+		"-f", "dash", "-seg_duration", segDuration, "-window_size", strconv.Itoa(windowSize), "-extra_window_size", "5",
+		"-streaming", "1", "-use_template", "1", "-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		filepath.Join(dirPath, "output.mpd"),
+		// Poster refreshed every 10 seconds
+		"-map", "0:v:0", "-vf", "fps=1/10,scale=640:-2", "-update", "1", "-f", "image2", filepath.Join(dirPath, "output.jpeg"),
+	)
+	if archivePath != "" {
+		args = append(args, "-map", "0:v:0")
+		if hasAudio {
+			args = append(args, "-map", "0:a:0")
+		}
+		args = append(args, "-c", "copy", "-f", "mpegts", archivePath)
+	}
+	return args
+}
+
+// userByStreamKey returns the user owning the given stream key.
+func userByStreamKey(key string) (User, bool) {
+	if key == "" {
+		return User{}, false
+	}
+	for _, user := range users {
+		if user.StreamKey != "" && subtle.ConstantTimeCompare([]byte(user.StreamKey), []byte(key)) == 1 {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// isLive reports whether the given video folder is currently fed by a live stream.
+func isLive(convertPath, videoName string) bool {
+	_, err := os.Stat(filepath.Join(convertPath, videoName, videoName+"live.txt"))
+	return err == nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metaFileName is the metadata file of the videos converted before the database, read by importVideoFolders.
+const metaFileName = "meta.json"
+
+// videoSidecarFiles are the files of a converted video folder that are not produced by the conversion,
+// they are carried over when the renditions are replaced.
+var videoSidecarFiles = []string{chaptersFileName}
+
+// videoMeta is the record of a video in the database.
+type videoMeta struct {
+	Title        string    `json:"title,omitempty"`
+	Description  string    `json:"description,omitempty"` // Markdown
+	Tags         []string  `json:"tags,omitempty"`
+	Uploader     string    `json:"uploader,omitempty"`
+	GuestUpload  bool      `json:"guestUpload,omitempty"` // uploaded by a guest, counted in the quota of the guests
+	OriginalName string    `json:"originalName,omitempty"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+	ArchiveFile  string    `json:"archiveFile,omitempty"` // path of the archived original, if any
+	Duration     float64   `json:"duration,omitempty"`    // seconds
+	Private      bool      `json:"private,omitempty"`     // encrypted, only for the uploader and the admins
+	AudioOnly    bool      `json:"audioOnly,omitempty"`
+	Live         bool      `json:"live,omitempty"` // fed by a running live stream
+	Size         int64     `json:"size,omitempty"` // bytes of the renditions
+}
+
+// canEditVideo reports whether the request comes from an admin or from the uploader of the video.
+func canEditVideo(r *http.Request, meta videoMeta) bool {
+	if adminAuthenticated(r) {
+		return true
+	}
+	if meta.Uploader == "" {
+		return false
+	}
+	user, ok := authenticatedUser(r)
+	return ok && user.Username == meta.Uploader
+}
+
+// copySidecarFiles copies the sidecar files from a video folder to another.
+func copySidecarFiles(fromDir, toDir string) error {
+	for _, name := range videoSidecarFiles {
+		data, err := ioutil.ReadFile(filepath.Join(fromDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(toDir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucketPlaylists = []byte("playlists") // playlist ID -> playlist
+
+// Visibility of a playlist: public playlists are listed in /playlists, unlisted ones are seen by whoever
+// has their link and private ones only by their owner and the admins.
+const (
+	playlistPublic   = "public"
+	playlistUnlisted = "unlisted"
+	playlistPrivate  = "private"
+)
+
+// Limits of a playlist
+const (
+	maxPlaylistTitleLen = 100 // characters
+	maxPlaylistVideos   = 500
+)
+
+// playlist is an ordered list of videos made by a user.
+type playlist struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"` // Markdown
+	Owner       string    `json:"owner"`
+	Visibility  string    `json:"visibility"`
+	Videos      []string  `json:"videos,omitempty"` // video IDs, in playing order
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// playlistEntry is a playlist of the /playlists page.
+type playlistEntry struct {
+	ID string
+	playlist
+	Count     int    // videos the viewer can see
+	Thumbnail string // ID of the first video, for its thumbnail
+}
+
+// playlistItem is a video of a playlist, as shown to a viewer.
+type playlistItem struct {
+	ID       string
+	Position int // from 1, among the videos the viewer can see
+	Title    string
+	Duration string
+	Current  bool // the video being played
+}
+
+// playlistView is a playlist next to the player of /vp?list=<id>.
+type playlistView struct {
+	ID      string
+	Title   string
+	Items   []playlistItem
+	Current string // ID of the video being played
+	Index   int    // position of the video being played, from 1
+	NextURL string // player of the next video, empty at the end of the playlist
+}
+
+// createPlaylists is the migration adding the playlists.
+func createPlaylists(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(bucketPlaylists)
+	return err
+}
+
+// findPlaylist returns a playlist, false if it doesn't exist.
+func findPlaylist(id string) (playlist, bool, error) {
+	var p playlist
+	var found bool
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketPlaylists).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &p)
+	})
+	return p, found, err
+}
+
+// savePlaylist adds or replaces a playlist.
+func savePlaylist(id string, p playlist) error {
+	p.UpdatedAt = time.Now()
+	return db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketPlaylists), id, p)
+	})
+}
+
+// deletePlaylist removes a playlist.
+func deletePlaylist(id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPlaylists).Delete([]byte(id))
+	})
+}
+
+// listPlaylists returns the playlists for which visible returns true, the most recently updated first.
+func listPlaylists(visible func(p playlist) bool) ([]playlistEntry, error) {
+	var entries []playlistEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPlaylists).ForEach(func(k, v []byte) error {
+			var p playlist
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if visible(p) {
+				entries = append(entries, playlistEntry{ID: string(k), playlist: p})
+			}
+			return nil
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].UpdatedAt.After(entries[j].UpdatedAt)
+	})
+	return entries, err
+}
+
+// removeFromPlaylists removes a deleted video from all the playlists.
+func removeFromPlaylists(tx *bolt.Tx, videoName string) error {
+	playlists := tx.Bucket(bucketPlaylists)
+	if playlists == nil {
+		return nil
+	}
+	changed := make(map[string]playlist)
+	err := playlists.ForEach(func(k, v []byte) error {
+		var p playlist
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		if i := indexOfVideo(p.Videos, videoName); i >= 0 {
+			p.Videos = append(p.Videos[:i], p.Videos[i+1:]...)
+			changed[string(k)] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id, p := range changed {
+		if err := putJSON(playlists, id, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newPlaylistID returns a random URL-safe ID not used by another playlist.
+func newPlaylistID() (string, error) {
+	random := make([]byte, 9)
+	for {
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		id := base64.RawURLEncoding.EncodeToString(random)
+		if _, found, err := findPlaylist(id); err != nil {
+			return "", err
+		} else if !found {
+			return id, nil
+		}
+	}
+}
+
+func indexOfVideo(videos []string, videoName string) int {
+	for i, v := range videos {
+		if v == videoName {
+			return i
+		}
+	}
+	return -1
+}
+
+// setPlaylistDetails checks the title, the Markdown description and the visibility of a playlist and sets them.
+func setPlaylistDetails(p *playlist, title, description, visibility string) error {
+	title = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, title))
+	if title == "" || !utf8.ValidString(title) || utf8.RuneCountInString(title) > maxPlaylistTitleLen {
+		return errors.New("Invalid title: it must be valid text, not longer than " + strconv.Itoa(maxPlaylistTitleLen) + " characters")
+	}
+	description = strings.TrimSpace(strings.ReplaceAll(description, "\r\n", "\n"))
+	if !utf8.ValidString(description) || utf8.RuneCountInString(description) > maxDescriptionLen {
+		return errors.New("Invalid description: it must be valid text, not longer than " + strconv.Itoa(maxDescriptionLen) + " characters")
+	}
+	switch visibility {
+	case playlistPublic, playlistUnlisted, playlistPrivate:
+	default:
+		return errors.New("Invalid visibility: use public, unlisted or private")
+	}
+	p.Title, p.Description, p.Visibility = title, description, visibility
+	return nil
+}
+
+// canEditPlaylist reports whether the request comes from the owner of the playlist or from an admin.
+func canEditPlaylist(r *http.Request, p playlist) bool {
+	if adminAuthenticated(r) {
+		return true
+	}
+	user, ok := authenticatedUser(r)
+	return ok && user.Username == p.Owner
+}
+
+// canViewPlaylist reports whether the request can see the playlist. Its videos are still checked one by one.
+func canViewPlaylist(r *http.Request, p playlist) bool {
+	if p.Visibility == playlistPrivate {
+		return canEditPlaylist(r, p)
+	}
+	return !AppConfig.VideoOnlyForUsers || adminAuthenticated(r) || userAuthenticated(r)
+}
+
+// playlistItems returns the videos of a playlist the request can view, in order.
+func playlistItems(r *http.Request, p playlist) ([]playlistItem, error) {
+	var items []playlistItem
+	for _, id := range p.Videos {
+		meta, found, err := findVideo(id)
+		if err != nil {
+			return nil, err
+		}
+		if !found || !canViewVideo(r, meta) {
+			continue
+		}
+		item := playlistItem{ID: id, Position: len(items) + 1, Title: meta.Title}
+		if item.Title == "" {
+			item.Title = id
+		}
+		if meta.Duration > 0 {
+			item.Duration = formatTimestamp(meta.Duration)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// newPlaylistView returns the playlist shown by the player of videoName, the first video if videoName is empty.
+// The next video keeps the player embedded if it is.
+func newPlaylistView(r *http.Request, id string, p playlist, videoName string, embedded bool) (*playlistView, error) {
+	items, err := playlistItems(r, p)
+	if err != nil {
+		return nil, err
+	}
+	view := &playlistView{ID: id, Title: p.Title, Items: items, Current: videoName}
+	if view.Current == "" && len(items) > 0 {
+		view.Current = items[0].ID
+	}
+	for i := range items {
+		if items[i].ID != view.Current {
+			continue
+		}
+		items[i].Current = true
+		view.Index = i + 1
+		if i+1 < len(items) {
+			view.NextURL = playlistPlayerURL(id, items[i+1].ID, embedded)
+		}
+	}
+	return view, nil
+}
+
+// playlistPlayerURL returns the player of a video of a playlist.
+func playlistPlayerURL(id, videoName string, embedded bool) string {
+	u := "/vp?videoname=" + url.QueryEscape(videoName) + "&list=" + url.QueryEscape(id)
+	if embedded {
+		u += "&embedded=1"
+	}
+	return u
+}
+
+// userPlaylists returns the playlists the request can add videos to, for the player.
+func userPlaylists(r *http.Request) []playlistEntry {
+	if _, ok := authenticatedUser(r); !ok {
+		return nil
+	}
+	entries, err := listPlaylists(func(p playlist) bool {
+		return canEditPlaylist(r, p)
+	})
+	if err != nil {
+		fmt.Println("Error listing the playlists:", err)
+	}
+	return entries
+}
+
+// playlistsHandler lists the public playlists and the ones of the user, and creates new playlists.
+func playlistsHandler(w http.ResponseWriter, r *http.Request) {
+	if AppConfig.VideoOnlyForUsers && !adminAuthenticated(r) && !userAuthenticated(r) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	user, loggedIn := authenticatedUser(r)
+	p := &PagePlaylists{CanCreate: loggedIn, Visibility: playlistPublic}
+
+	if r.Method == http.MethodPost {
+		if !loggedIn {
+			http.Redirect(w, r, "/auth", http.StatusSeeOther)
+			return
+		}
+		p.Title, p.Description, p.Visibility = r.FormValue("title"), r.FormValue("description"), r.FormValue("visibility")
+		pl := playlist{Owner: user.Username, CreatedAt: time.Now()}
+		err := setPlaylistDetails(&pl, p.Title, p.Description, p.Visibility)
+		var id string
+		if err == nil {
+			id, err = newPlaylistID()
+		}
+		if err == nil {
+			err = savePlaylist(id, pl)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/playlist?list="+id, http.StatusSeeOther)
+			return
+		}
+		p.ErrMsg = err.Error()
+	}
+
+	entries, err := listPlaylists(func(pl playlist) bool {
+		return pl.Visibility == playlistPublic || (loggedIn && canEditPlaylist(r, pl))
+	})
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	for i := range entries {
+		items, err := playlistItems(r, entries[i].playlist)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		entries[i].Count = len(items)
+		if len(items) > 0 {
+			entries[i].Thumbnail = items[0].ID
+		}
+	}
+	p.Playlists = entries
+	renderTemplate(w, "playlists", p)
+}
+
+// playlistHandler shows a playlist (/playlist?list=<id>). Its owner and the admins can change its details,
+// add, move and remove videos and delete it with a POST and an action.
+func playlistHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("list") // in the form of the player, to add the video to the chosen playlist
+	if !isSafeFileName(id) {
+		sendError(w, r, "Invalid playlist")
+		return
+	}
+	pl, found, err := findPlaylist(id)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if !found {
+		sendError(w, r, "Playlist not found")
+		return
+	}
+	if !canViewPlaylist(r, pl) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	canEdit := canEditPlaylist(r, pl)
+	p := &PagePlaylist{
+		ID:          id,
+		Title:       pl.Title,
+		Description: pl.Description,
+		Visibility:  pl.Visibility,
+		Owner:       pl.Owner,
+		CanEdit:     canEdit,
+		Embed:       AppConfig.AllowEmbedded && pl.Visibility != playlistPrivate,
+	}
+
+	if r.Method == http.MethodPost {
+		if !canEdit {
+			http.Redirect(w, r, "/auth", http.StatusSeeOther)
+			return
+		}
+		videoname := r.FormValue("videoname")
+		redirect := "/playlist?list=" + id
+		switch r.FormValue("action") {
+		case "save":
+			p.Title, p.Description, p.Visibility = r.FormValue("title"), r.FormValue("description"), r.FormValue("visibility")
+			err = setPlaylistDetails(&pl, p.Title, p.Description, p.Visibility)
+		case "add":
+			err = addToPlaylist(r, &pl, videoname)
+			redirect = "/vp?videoname=" + url.QueryEscape(videoname)
+		case "up", "down", "remove":
+			err = moveInPlaylist(&pl, videoname, r.FormValue("action"))
+		case "delete":
+			if err := deletePlaylist(id); err != nil {
+				sendError(w, r, err.Error())
+				return
+			}
+			http.Redirect(w, r, "/playlists", http.StatusSeeOther)
+			return
+		default:
+			err = errors.New("Invalid action")
+		}
+		if err == nil {
+			err = savePlaylist(id, pl)
+		}
+		if err == nil {
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+		p.ErrMsg = err.Error()
+	}
+
+	p.Items, err = playlistItems(r, pl)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	p.RenderedDescription = renderDescription(pl.Description)
+	renderTemplate(w, "playlist", p)
+}
+
+// addToPlaylist appends a video the request can view to the playlist.
+func addToPlaylist(r *http.Request, pl *playlist, videoName string) error {
+	if !isSafeFileName(videoName) {
+		return errors.New("Invalid video name")
+	}
+	meta, found, err := findVideo(videoName)
+	if err != nil {
+		return err
+	}
+	if !found || !canViewVideo(r, meta) {
+		return errors.New("Video not found: " + videoName)
+	}
+	if indexOfVideo(pl.Videos, videoName) >= 0 {
+		return errors.New("The video is already in the playlist")
+	}
+	if len(pl.Videos) >= maxPlaylistVideos {
+		return errors.New("A playlist can't have more than " + strconv.Itoa(maxPlaylistVideos) + " videos")
+	}
+	pl.Videos = append(pl.Videos, videoName)
+	return nil
+}
+
+// moveInPlaylist moves a video one place up or down, or removes it.
+func moveInPlaylist(pl *playlist, videoName, action string) error {
+	i := indexOfVideo(pl.Videos, videoName)
+	if i < 0 {
+		return errors.New("The video is not in the playlist")
+	}
+	switch action {
+	case "up":
+		if i > 0 {
+			pl.Videos[i-1], pl.Videos[i] = pl.Videos[i], pl.Videos[i-1]
+		}
+	case "down":
+		if i < len(pl.Videos)-1 {
+			pl.Videos[i+1], pl.Videos[i] = pl.Videos[i], pl.Videos[i+1]
+		}
+	case "remove":
+		pl.Videos = append(pl.Videos[:i], pl.Videos[i+1:]...)
+	}
+	return nil
+}
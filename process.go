@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// appCtx is cancelled on server shutdown, every child process is started under it
+	appCtx         = context.Background()
+	activeCommands sync.WaitGroup
+
+	conversions   = make(map[string]context.CancelFunc) // video name -> cancel function of its conversion
+	conversionsMu sync.Mutex
+)
+
+// registerConversion creates the context of a video conversion, cancellable with cancelConversion.
+func registerConversion(videoName string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(appCtx)
+	conversionsMu.Lock()
+	conversions[videoName] = cancel
+	conversionsMu.Unlock()
+	return ctx, func() {
+		conversionsMu.Lock()
+		delete(conversions, videoName)
+		conversionsMu.Unlock()
+		cancel()
+	}
+}
+
+// cancelConversion kills the running jobs of a video and drops the queued ones.
+func cancelConversion(videoName string) bool {
+	conversionsMu.Lock()
+	defer conversionsMu.Unlock()
+	cancel, ok := conversions[videoName]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// runningConversions returns the names of the videos being converted.
+func runningConversions() []string {
+	conversionsMu.Lock()
+	defer conversionsMu.Unlock()
+	names := make([]string, 0, len(conversions))
+	for name := range conversions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// convTimeout returns the maximum run time of a conversion job for a source of the given duration (seconds).
+// Zero means no timeout.
+func convTimeout(duration float64) time.Duration {
+	base, err := time.ParseDuration(AppConfig.ConvTimeoutBase)
+	if err != nil {
+		base = 0
+	}
+	if base == 0 && AppConfig.ConvTimeoutFactor <= 0 {
+		return 0
+	}
+	return base + time.Duration(duration*float64(AppConfig.ConvTimeoutFactor)*float64(time.Second))
+}
+
+// newConvCommand creates a conversion command running at the configured CPU/IO priority and memory limit.
+// The whole process group is killed when ctx is done.
+func newConvCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	var wrapper []string
+	if AppConfig.ConvMemLimitMB > 0 {
+		wrapper = append(wrapper, "prlimit", "--as="+strconv.FormatInt(int64(AppConfig.ConvMemLimitMB)*1024*1024, 10), "--")
+	}
+	if AppConfig.ConvNice > 0 {
+		wrapper = append(wrapper, "nice", "-n", strconv.Itoa(AppConfig.ConvNice))
+	}
+	switch AppConfig.ConvIOClass {
+	case "idle":
+		wrapper = append(wrapper, "ionice", "-c", "3")
+	case "best-effort":
+		wrapper = append(wrapper, "ionice", "-c", "2", "-n", "7")
+	}
+	if len(wrapper) > 0 {
+		args = append(append(wrapper[1:], name), args...)
+		name = wrapper[0]
+	}
+	return newCommand(ctx, name, args...)
+}
+
+// newCommand creates a command in its own process group, killed with all its children when ctx is done.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
+
+// runConvCommand runs a command created under ctx, the server waits for it on shutdown.
+func runConvCommand(ctx context.Context, cmd *exec.Cmd) error {
+	activeCommands.Add(1)
+	defer activeCommands.Done()
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w (%v)", err, ctx.Err())
+	}
+	return err
+}
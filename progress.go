@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stages of the pipeline of a video, sent to the upload pages by /progress
+const (
+	stageDownloading = "downloading" // import from URL
+	stageQueued      = "queued"
+	stageConverting  = "converting"
+	stagePackaging   = "packaging"
+	stageReady       = "ready"
+	stageFailed      = "failed"
+)
+
+// maxProgressVideos is the max number of videos followed by a /progress request.
+const maxProgressVideos = 50
+
+// progressKeep is how long the last event of a finished video is kept for the late subscribers.
+const progressKeep = 10 * time.Minute
+
+// progressEvent is the state of the pipeline of a video.
+type progressEvent struct {
+	Video    string `json:"video"`
+	Stage    string `json:"stage"`
+	Position int    `json:"position,omitempty"` // queued videos ahead, plus one
+	Percent  int    `json:"percent"`
+	Message  string `json:"message,omitempty"`
+}
+
+// videoProgress tracks the conversion jobs of a video and the clients following it.
+type videoProgress struct {
+	name        string
+	event       progressEvent
+	queuedAt    time.Time
+	finishedAt  time.Time
+	jobs        int                // number of conversion jobs
+	done        map[string]float64 // job -> completed fraction
+	subscribers map[chan progressEvent]bool
+}
+
+var (
+	progressMu sync.Mutex
+	progresses = make(map[string]*videoProgress) // video ID -> progress
+)
+
+// getProgress returns the progress of a video, creating it. progressMu must be held.
+func getProgress(videoName string) *videoProgress {
+	p, ok := progresses[videoName]
+	if !ok {
+		p = &videoProgress{name: videoName, done: make(map[string]float64), subscribers: make(map[chan progressEvent]bool)}
+		progresses[videoName] = p
+	}
+	return p
+}
+
+// publish sends the event of a video to its subscribers, a slow client misses the intermediate events.
+// progressMu must be held.
+func (p *videoProgress) publish(event progressEvent) {
+	event.Video = p.name
+	p.event = event
+	for ch := range p.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// setProgressStage moves a video to a stage of the pipeline.
+func setProgressStage(videoName, stage, message string) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p := getProgress(videoName)
+	event := progressEvent{Stage: stage, Percent: p.event.Percent, Message: message}
+	switch stage {
+	case stageDownloading:
+		event.Percent = 0
+	case stagePackaging:
+		event.Percent = 95
+	case stageReady:
+		event.Percent = 100
+	}
+	p.publish(event)
+	if stage == stageReady || stage == stageFailed {
+		p.finishedAt = time.Now()
+		time.AfterFunc(progressKeep, func() {
+			progressMu.Lock()
+			defer progressMu.Unlock()
+			if progresses[videoName] == p && len(p.subscribers) == 0 {
+				delete(progresses, videoName)
+			}
+		})
+	}
+	updateQueuePositions()
+}
+
+// startProgress queues a video for conversion.
+func startProgress(videoName string) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p := getProgress(videoName)
+	p.jobs = 0
+	p.done = make(map[string]float64)
+	p.queuedAt = time.Now()
+	p.finishedAt = time.Time{}
+	p.publish(progressEvent{Stage: stageQueued})
+	updateQueuePositions()
+}
+
+// setProgressJobs sets the number of conversion jobs of a video, once known.
+func setProgressJobs(videoName string, jobs int) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	getProgress(videoName).jobs = jobs
+}
+
+// setJobProgress records the completed fraction of a conversion job of a video.
+// The videos not followed (e.g. scene detection of a ready video) are ignored.
+func setJobProgress(videoName, job string, fraction float64) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p, ok := progresses[videoName]
+	if !ok || p.jobs == 0 || (p.event.Stage != stageQueued && p.event.Stage != stageConverting) {
+		return
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	p.done[job] = fraction
+	var total float64
+	for _, f := range p.done {
+		total += f
+	}
+	percent := int(total / float64(p.jobs) * 90)
+	if p.event.Stage == stageConverting && percent == p.event.Percent {
+		return
+	}
+	wasQueued := p.event.Stage == stageQueued
+	p.publish(progressEvent{Stage: stageConverting, Percent: percent})
+	if wasQueued {
+		updateQueuePositions()
+	}
+}
+
+// updateQueuePositions sends the new queue position to the queued videos. progressMu must be held.
+func updateQueuePositions() {
+	for _, p := range progresses {
+		if p.event.Stage != stageQueued {
+			continue
+		}
+		position := 1
+		for _, other := range progresses {
+			if other.event.Stage == stageQueued && other.queuedAt.Before(p.queuedAt) {
+				position++
+			}
+		}
+		if position != p.event.Position {
+			event := p.event
+			event.Position = position
+			p.publish(event)
+		}
+	}
+}
+
+// subscribeProgress sends the next events of a video to ch and returns the last one.
+// The same channel can follow several videos.
+func subscribeProgress(videoName string, ch chan progressEvent) (progressEvent, func()) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p := getProgress(videoName)
+	p.subscribers[ch] = true
+	unsubscribe := func() {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		delete(p.subscribers, ch)
+		unknown := p.event.Stage == ""
+		expired := !p.finishedAt.IsZero() && time.Since(p.finishedAt) >= progressKeep
+		if len(p.subscribers) == 0 && progresses[videoName] == p && (unknown || expired) {
+			delete(progresses, videoName)
+		}
+	}
+	event := p.event
+	event.Video = videoName
+	return event, unsubscribe
+}
+
+// ffmpegProgress receives the output of ffmpeg -progress and updates the progress of the job.
+type ffmpegProgress struct {
+	videoName string
+	job       string
+	duration  float64 // seconds, 0 if unknown
+	line      []byte
+}
+
+func (f *ffmpegProgress) Write(data []byte) (int, error) {
+	for _, b := range data {
+		if b != '\n' {
+			f.line = append(f.line, b)
+			continue
+		}
+		key, value, _ := strings.Cut(string(f.line), "=")
+		f.line = f.line[:0]
+		if key != "out_time_us" || f.duration <= 0 {
+			continue
+		}
+		if us, err := strconv.ParseFloat(value, 64); err == nil && us > 0 {
+			setJobProgress(f.videoName, f.job, us/1e6/f.duration)
+		}
+	}
+	return len(data), nil
+}
+
+// newFFmpegCommand returns the ffmpeg command of a conversion job, reporting its progress.
+func newFFmpegCommand(ctx context.Context, params VideoParams, args ...string) *exec.Cmd {
+	cmd := newConvCommand(ctx, "/usr/bin/ffmpeg", append([]string{"-progress", "pipe:1", "-nostats"}, args...)...)
+	cmd.Stdout = &ffmpegProgress{videoName: params.videoName, job: filepath.Base(params.ConvertPath), duration: params.duration}
+	return cmd
+}
+
+// isConverted reports whether the DASH stream of a video is available.
+func isConverted(videoName string) bool {
+	_, err := os.Stat(filepath.Join(AppConfig.ConvertPath, videoName, "output.mpd"))
+	return err == nil
+}
+
+// progressHandler streams with Server-Sent Events the pipeline events of one or more videos
+// (/progress?videoname=a&videoname=b), until they are ready or failed.
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	videonames := r.URL.Query()["videoname"]
+	if len(videonames) == 0 || len(videonames) > maxProgressVideos {
+		http.Error(w, "Invalid video name", http.StatusBadRequest)
+		return
+	}
+	for _, videoname := range videonames {
+		if !isSafeFileName(videoname) {
+			http.Error(w, "Invalid video name", http.StatusBadRequest)
+			return
+		}
+		meta, err := loadVideoMeta(videoname)
+		if err != nil || !canViewVideo(r, meta) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	events := make(chan progressEvent, 16*len(videonames))
+	pending := make(map[string]bool)
+	send := func(event progressEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if event.Stage == stageReady || event.Stage == stageFailed {
+			delete(pending, event.Video)
+		}
+		_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+		return err
+	}
+	for _, videoname := range videonames {
+		event, unsubscribe := subscribeProgress(videoname, events)
+		defer unsubscribe()
+		pending[videoname] = true
+		if event.Stage == "" && isConverted(videoname) {
+			event = progressEvent{Video: videoname, Stage: stageReady, Percent: 100}
+		}
+		// A video not known yet (e.g. being validated) waits for its first event
+		if event.Stage != "" {
+			if err := send(event); err != nil {
+				return
+			}
+		}
+	}
+	if len(pending) > 0 {
+		fmt.Fprint(w, ": following\n\n")
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for len(pending) > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-appCtx.Done():
+			return
+		case event := <-events:
+			if !pending[event.Video] {
+				continue
+			}
+			if err := send(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// UploadQuota limits what a user can upload. Zero values mean no limit.
+type UploadQuota struct {
+	VideosPerHour int     `yaml:"VideosPerHour" json:"VideosPerHour"`
+	VideosPerDay  int     `yaml:"VideosPerDay" json:"VideosPerDay"`
+	MaxStorage    int64   `yaml:"MaxStorage" json:"MaxStorage"` // bytes used by the converted videos
+	MaxMinutes    float64 `yaml:"MaxMinutes" json:"MaxMinutes"` // total duration of the videos
+}
+
+// quotaUsage is what a user has uploaded, counted against its quota.
+type quotaUsage struct {
+	VideosLastHour int
+	VideosLastDay  int
+	Storage        int64
+	Minutes        float64
+}
+
+var videosUploaded atomic.Int64 // uploads of every user in the current hour, see MaxVideosPerHour
+
+// quotaStatus is the usage of a user shown in the upload page.
+type quotaStatus struct {
+	Quota      UploadQuota
+	Usage      quotaUsage
+	Storage    string
+	MaxStorage string
+	Minutes    string
+}
+
+// newQuotaStatus returns the quota and the usage of a user, nil if the user has no quota.
+func newQuotaStatus(username, role string) *quotaStatus {
+	quota, ok := userQuota(username, role)
+	if !ok {
+		return nil
+	}
+	usage := userUsage(username)
+	return &quotaStatus{
+		Quota:      quota,
+		Usage:      usage,
+		Storage:    formatBytes(usage.Storage),
+		MaxStorage: formatBytes(quota.MaxStorage),
+		Minutes:    strconv.FormatFloat(usage.Minutes, 'f', 0, 64),
+	}
+}
+
+// userQuota returns the quota of a user: its own entry in UserQuotas, otherwise the one of its role in RoleQuotas.
+func userQuota(username, role string) (UploadQuota, bool) {
+	if quota, ok := AppConfig.UserQuotas[username]; ok && username != "" {
+		return quota, true
+	}
+	quota, ok := AppConfig.RoleQuotas[role]
+	return quota, ok
+}
+
+// checkUploadLimits returns an error if a new video can't be uploaded by the user, because of MaxVideosPerHour
+// or of its quota. The guests share the same quota.
+func checkUploadLimits(username, role string) error {
+	if videosUploaded.Load() >= int64(AppConfig.MaxVideosPerHour) {
+		return errors.New("Can't upload more than " + strconv.Itoa(AppConfig.MaxVideosPerHour) + " videos per hour")
+	}
+	quota, ok := userQuota(username, role)
+	if !ok {
+		return nil
+	}
+	usage := userUsage(username)
+	if quota.VideosPerHour > 0 && usage.VideosLastHour >= quota.VideosPerHour {
+		return errors.New("Quota exceeded: you can't upload more than " + strconv.Itoa(quota.VideosPerHour) + " videos per hour")
+	}
+	if quota.VideosPerDay > 0 && usage.VideosLastDay >= quota.VideosPerDay {
+		return errors.New("Quota exceeded: you can't upload more than " + strconv.Itoa(quota.VideosPerDay) + " videos per day")
+	}
+	if quota.MaxStorage > 0 && usage.Storage >= quota.MaxStorage {
+		return errors.New("Quota exceeded: your videos already use " + formatBytes(usage.Storage) + " of " + formatBytes(quota.MaxStorage))
+	}
+	if quota.MaxMinutes > 0 && usage.Minutes >= quota.MaxMinutes {
+		return fmt.Errorf("Quota exceeded: your videos already last %.0f of %.0f minutes", usage.Minutes, quota.MaxMinutes)
+	}
+	return nil
+}
+
+// checkStorageQuota returns an error if a file of the given size doesn't fit in the storage quota of the user.
+func checkStorageQuota(username, role string, size int64) error {
+	quota, ok := userQuota(username, role)
+	if !ok || quota.MaxStorage <= 0 {
+		return nil
+	}
+	if usage := userUsage(username); usage.Storage+size > quota.MaxStorage {
+		return errors.New("Quota exceeded: the file doesn't fit in your storage quota, " + formatBytes(quota.MaxStorage-usage.Storage) + " left")
+	}
+	return nil
+}
+
+// checkMinutesQuota returns an error if a video of the given duration (seconds) doesn't fit in the minutes
+// quota of the user.
+func checkMinutesQuota(username, role string, duration float64) error {
+	quota, ok := userQuota(username, role)
+	if !ok || quota.MaxMinutes <= 0 {
+		return nil
+	}
+	if usage := userUsage(username); usage.Minutes+duration/60 > quota.MaxMinutes {
+		return fmt.Errorf("Quota exceeded: the video lasts %.0f minutes, %.0f of your %.0f minutes are left", duration/60, math.Max(quota.MaxMinutes-usage.Minutes, 0), quota.MaxMinutes)
+	}
+	return nil
+}
+
+// countUpload records a new upload of the user, once its file has been reserved.
+func countUpload(username string) {
+	videosUploaded.Add(1)
+	if err := addUserUpload(username, time.Now()); err != nil {
+		fmt.Println("Error saving the upload of", username+":", err)
+	}
+}
+
+// userUsage counts the uploads of the user in the last hour and day and sums the size and the duration
+// of its videos in the library. The usage of the guests (username "") counts only the videos uploaded by guests.
+func userUsage(username string) quotaUsage {
+	var usage quotaUsage
+	uploads, err := userUploads(username)
+	if err != nil {
+		fmt.Println("Error reading the uploads of", username+":", err)
+	}
+	for _, t := range uploads {
+		if time.Since(t) < time.Hour {
+			usage.VideosLastHour++
+		}
+		if time.Since(t) < 24*time.Hour {
+			usage.VideosLastDay++
+		}
+	}
+
+	err = forEachVideo(func(_ string, meta videoMeta) {
+		if meta.Uploader == username && (username != "" || meta.GuestUpload) {
+			usage.Storage += meta.Size
+			usage.Minutes += meta.Duration / 60
+		}
+	})
+	if err != nil {
+		fmt.Println("Error reading the quota usage:", err)
+	}
+	return usage
+}
+
+// dirSize returns the total size of the files in a folder, or in the folder it links to.
+func dirSize(dirPath string) int64 {
+	if resolved, err := filepath.EvalSymlinks(dirPath); err == nil {
+		dirPath = resolved
+	}
+	var size int64
+	filepath.Walk(dirPath, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// formatBytes formats a size in B, KB, MB or GB.
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+	value, suffix := float64(size), "B"
+	for _, s := range []string{"KB", "MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, s
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
+
+// resetVideoUploadedCounter resets every hour the counter checked against MaxVideosPerHour.
+func resetVideoUploadedCounter() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-appCtx.Done():
+			return
+		case <-ticker.C:
+			videosUploaded.Store(0)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGuestUsageCountsOnlyGuestUploads(t *testing.T) {
+	openTestStore(t, t.TempDir())
+	videos := map[string]videoMeta{
+		"guestVideo01": {Uploader: "", GuestUpload: true, Size: 100, Duration: 60},
+		"legacyVideo1": {Uploader: "", Size: 1000, Duration: 600},   // imported from an older version
+		"watchVideo01": {Uploader: "", Size: 10000, Duration: 6000}, // watch folder without WatchUploader
+		"aliceVideo01": {Uploader: "alice", Size: 5, Duration: 120},
+	}
+	for id, meta := range videos {
+		meta.UploadedAt = time.Now()
+		if err := saveVideoMeta(id, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if usage := userUsage(""); usage.Storage != 100 || usage.Minutes != 1 {
+		t.Errorf("guest usage %d bytes and %.0f minutes, want 100 bytes and 1 minute", usage.Storage, usage.Minutes)
+	}
+	if usage := userUsage("alice"); usage.Storage != 5 || usage.Minutes != 2 {
+		t.Errorf("alice usage %d bytes and %.0f minutes, want 5 bytes and 2 minutes", usage.Storage, usage.Minutes)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Requests requests per Window to each client of a route group.
+type RateLimit struct {
+	Requests int    `yaml:"Requests" json:"Requests"`
+	Window   string `yaml:"Window" json:"Window"` // e.g. "1m"
+}
+
+// rateWindow is the state of a client: the requests of the current and of the previous fixed window.
+// The sliding window count is the current count plus the previous one weighted by the part of the
+// previous window still inside the sliding window.
+type rateWindow struct {
+	window      time.Duration
+	start       time.Time
+	prev, curr  int
+	blocked     int
+	lastBlocked time.Time
+}
+
+// rateLimitState is a client of the rate limiter, shown in the admin panel.
+type rateLimitState struct {
+	Group       string
+	Client      string
+	Requests    int // in the sliding window
+	Limit       int
+	Blocked     int
+	LastBlocked string
+}
+
+var (
+	rateLimitMu      sync.Mutex
+	rateLimitWindows = make(map[string]*rateWindow) // group + " " + client -> state
+)
+
+// rateLimited wraps the handler of a route group (login, upload, api, media) with the rate limit of the group.
+// A client exceeding the limit gets a 429 response with Retry-After.
+func rateLimited(group string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := AppConfig.RateLimits[group]
+		if !ok || limit.Requests <= 0 {
+			next(w, r)
+			return
+		}
+		window, err := time.ParseDuration(limit.Window)
+		if err != nil || window <= 0 {
+			fmt.Println("Invalid Window of RateLimits", group, "in config.yaml:", limit.Window)
+			next(w, r)
+			return
+		}
+		retryAfter, ok := allowRequest(group, rateLimitClient(group, r), limit.Requests, window)
+		if !ok {
+			seconds := strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+			w.Header().Set("Retry-After", seconds)
+			http.Error(w, "Too many requests, retry in "+seconds+" seconds", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateLimitClient returns the key of the client: the logged in user, or the IP address for the guests and for the logins.
+func rateLimitClient(group string, r *http.Request) string {
+	if group != "login" {
+		if username := requestUsername(r); username != "" {
+			return "user:" + username
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// allowRequest counts a request of the client, if the limit is not reached. Otherwise it returns
+// how long the client has to wait.
+func allowRequest(group, client string, limit int, window time.Duration) (time.Duration, bool) {
+	return allowRequestAt(time.Now(), group, client, limit, window)
+}
+
+// allowRequestAt is allowRequest for a request received at now.
+func allowRequestAt(now time.Time, group, client string, limit int, window time.Duration) (time.Duration, bool) {
+	start := now.Truncate(window)
+
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	key := group + " " + client
+	rw, ok := rateLimitWindows[key]
+	if !ok || rw.window != window {
+		rw = &rateWindow{window: window, start: start}
+		rateLimitWindows[key] = rw
+	}
+	rw.advance(start)
+
+	elapsed := now.Sub(start)
+	if rw.count(elapsed) < float64(limit) {
+		rw.curr++
+		return 0, true
+	}
+	rw.blocked++
+	rw.lastBlocked = now
+
+	// Time until the sliding count goes below the limit
+	var wait time.Duration
+	prev, curr := float64(rw.prev), float64(rw.curr)
+	if curr < float64(limit) && prev > 0 {
+		wait = time.Duration(float64(window)*(1-(float64(limit)-curr)/prev)) - elapsed
+	} else {
+		wait = window - elapsed + time.Duration(float64(window)*(1-float64(limit)/curr))
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait, false
+}
+
+// advance moves the window to the fixed window starting at start.
+func (rw *rateWindow) advance(start time.Time) {
+	switch {
+	case !start.After(rw.start):
+	case start.Sub(rw.start) == rw.window:
+		rw.prev, rw.curr = rw.curr, 0
+	default:
+		rw.prev, rw.curr = 0, 0
+	}
+	if start.After(rw.start) {
+		rw.start = start
+	}
+}
+
+// count returns the requests in the sliding window ending elapsed after the start of the current window.
+func (rw *rateWindow) count(elapsed time.Duration) float64 {
+	return float64(rw.prev)*(1-float64(elapsed)/float64(rw.window)) + float64(rw.curr)
+}
+
+// clientIP returns the IP address of the client. X-Forwarded-For and X-Real-IP are used only when the request
+// comes from one of the TrustedProxies, the address added by the last untrusted hop is taken.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+// isTrustedProxy reports whether ip is in TrustedProxies (comma separated IPs and CIDRs).
+func isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil || AppConfig.TrustedProxies == "" {
+		return false
+	}
+	for _, proxy := range strings.Split(AppConfig.TrustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if trusted := net.ParseIP(proxy); trusted != nil && trusted.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitStates returns the clients of the rate limiter, the blocked ones first.
+func rateLimitStates() []rateLimitState {
+	now := time.Now()
+	rateLimitMu.Lock()
+	var states []rateLimitState
+	for key, rw := range rateLimitWindows {
+		group, client, _ := strings.Cut(key, " ")
+		start := now.Truncate(rw.window)
+		rw.advance(start)
+		state := rateLimitState{
+			Group:    group,
+			Client:   client,
+			Requests: int(math.Ceil(rw.count(now.Sub(start)))),
+			Limit:    AppConfig.RateLimits[group].Requests,
+			Blocked:  rw.blocked,
+		}
+		if !rw.lastBlocked.IsZero() {
+			state.LastBlocked = rw.lastBlocked.Format("Jan 02, 2006 15:04:05")
+		}
+		states = append(states, state)
+	}
+	rateLimitMu.Unlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Blocked != states[j].Blocked {
+			return states[i].Blocked > states[j].Blocked
+		}
+		return states[i].Requests > states[j].Requests
+	})
+	return states
+}
+
+// deleteIdleRateLimits removes every minute the clients without requests in the last two windows.
+func deleteIdleRateLimits() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-appCtx.Done():
+			return
+		case now := <-ticker.C:
+			rateLimitMu.Lock()
+			for key, rw := range rateLimitWindows {
+				if now.Sub(rw.start) >= 2*rw.window {
+					delete(rateLimitWindows, key)
+				}
+			}
+			rateLimitMu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAllowRequest(t *testing.T) {
+	saved := rateLimitWindows
+	t.Cleanup(func() { rateLimitWindows = saved })
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC) // start of a window
+
+	type request struct {
+		at      time.Duration // after base
+		allowed bool
+		wait    time.Duration // Retry-After of a blocked request
+	}
+	tests := []struct {
+		name     string
+		limit    int
+		requests []request
+	}{
+		{"limit reached within a window", 4, []request{
+			{0, true, 0},
+			{time.Second, true, 0},
+			{2 * time.Second, true, 0},
+			{3 * time.Second, true, 0},
+			{10 * time.Second, false, 50 * time.Second},
+			{59 * time.Second, false, time.Second},
+		}},
+		{"previous window decays across the boundary", 4, []request{
+			{50 * time.Second, true, 0},
+			{51 * time.Second, true, 0},
+			{52 * time.Second, true, 0},
+			{53 * time.Second, true, 0},
+			// 4 * (1 - 10/60) = 3.33 requests in the sliding window
+			{70 * time.Second, true, 0},
+			// 4 * (1 - 11/60) + 1 = 4.27, below the limit after 15s of the window
+			{71 * time.Second, false, 4 * time.Second},
+			{75*time.Second + 500*time.Millisecond, true, 0},
+		}},
+		{"idle for more than a window", 2, []request{
+			{0, true, 0},
+			{time.Second, true, 0},
+			{2 * time.Second, false, 58 * time.Second},
+			{130 * time.Second, true, 0},
+			{131 * time.Second, true, 0},
+		}},
+		{"Retry-After of at least a second", 1, []request{
+			{0, true, 0},
+			{59*time.Second + 900*time.Millisecond, false, time.Second},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rateLimitWindows = make(map[string]*rateWindow)
+			for i, req := range tt.requests {
+				wait, allowed := allowRequestAt(base.Add(req.at), "api", "ip:192.0.2.1", tt.limit, time.Minute)
+				if allowed != req.allowed {
+					t.Fatalf("request %d at +%v: allowed %v, want %v", i+1, req.at, allowed, req.allowed)
+				}
+				if !allowed && wait.Round(time.Millisecond) != req.wait {
+					t.Errorf("request %d at +%v: wait %v, want %v", i+1, req.at, wait, req.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	saved := AppConfig
+	t.Cleanup(func() { AppConfig = saved })
+
+	tests := []struct {
+		name           string
+		trustedProxies string
+		remoteAddr     string
+		forwardedFor   string
+		realIP         string
+		want           string
+	}{
+		{"no proxy", "", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"spoofed X-Forwarded-For from an untrusted peer", "10.0.0.1", "203.0.113.5:1234", "198.51.100.7", "", "203.0.113.5"},
+		{"spoofed X-Real-IP from an untrusted peer", "10.0.0.1", "203.0.113.5:1234", "", "198.51.100.7", "203.0.113.5"},
+		{"X-Forwarded-For ignored without TrustedProxies", "", "10.0.0.1:1234", "198.51.100.7", "", "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1", "10.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1, 192.168.0.0/16", "10.0.0.1:1234", "1.2.3.4, 198.51.100.7, 192.168.1.2", "", "198.51.100.7"},
+		{"address prepended by the client", "10.0.0.1", "10.0.0.1:1234", "1.2.3.4, 198.51.100.7", "", "198.51.100.7"},
+		{"invalid hop", "10.0.0.1", "10.0.0.1:1234", "unknown", "", "10.0.0.1"},
+		{"X-Real-IP from a trusted proxy", "10.0.0.1", "10.0.0.1:1234", "", "198.51.100.7", "198.51.100.7"},
+		{"IPv6 peer", "", "[2001:db8::1]:1234", "198.51.100.7", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AppConfig.TrustedProxies = tt.trustedProxies
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitedSetsRetryAfter(t *testing.T) {
+	saved, savedWindows := AppConfig, rateLimitWindows
+	t.Cleanup(func() { AppConfig, rateLimitWindows = saved, savedWindows })
+	rateLimitWindows = make(map[string]*rateWindow)
+	AppConfig.RateLimits = map[string]RateLimit{"api": {Requests: 1, Window: "1m"}}
+	handler := rateLimited("api", func(w http.ResponseWriter, r *http.Request) {})
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		handler(w, r)
+		if w.Code != want {
+			t.Fatalf("request %d: status %d, want %d", i+1, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests {
+			seconds, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			if err != nil || seconds < 1 || seconds > 60 {
+				t.Errorf("Retry-After %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+			}
+		}
+	}
+}
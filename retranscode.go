@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const retranscodeDir = ".retranscode" // work folder inside ConvertPath, hidden from the video list
+
+var (
+	retranscoding   = make(map[string]bool)
+	retranscodingMu sync.Mutex
+)
+
+// retranscodeHandler re-processes one video (?videoname=) or the whole library (?all=1) with the current settings.
+func retranscodeHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthenticated(r) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	var names []string
+	if r.URL.Query().Get("all") == "1" {
+		all, err := listVideoNames()
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		names = all
+	} else {
+		videoname := r.URL.Query().Get("videoname")
+		if !isSafeFileName(videoname) {
+			sendError(w, r, "Invalid video name")
+			return
+		}
+		names = []string{videoname}
+	}
+	go retranscodeVideos(names)
+	http.Redirect(w, r, "/queque", http.StatusSeeOther)
+}
+
+// retranscodeCommand implements the "retranscode" command line subcommand:
+// GoTube retranscode -all | <videoname>...
+func retranscodeCommand(args []string) {
+	var names []string
+	if len(args) == 1 && args[0] == "-all" {
+		all, err := listVideoNames()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		names = all
+	} else {
+		for _, name := range args {
+			if !isSafeFileName(name) {
+				fmt.Println("Invalid video name:", name)
+				os.Exit(1)
+			}
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("Usage: GoTube retranscode -all | <videoname>...")
+		os.Exit(1)
+	}
+	if !retranscodeVideos(names) {
+		os.Exit(1)
+	}
+}
+
+// retranscodeVideos re-processes the given videos one after the other, returns false if at least one failed.
+func retranscodeVideos(names []string) bool {
+	ok := true
+	for _, name := range names {
+		if err := retranscodeVideo(name); err != nil {
+			fmt.Printf("Error re-transcoding %s: %v\n", name, err)
+			ok = false
+		} else {
+			fmt.Println("Re-transcoding completed:", name)
+		}
+	}
+	return ok
+}
+
+// retranscodeVideo converts again a video under the current settings in a work folder,
+// the old renditions are served until the new ones are swapped in (see swapVideoFolder).
+func retranscodeVideo(name string) error {
+	retranscodingMu.Lock()
+	if retranscoding[name] {
+		retranscodingMu.Unlock()
+		return errors.New("re-transcoding already in progress")
+	}
+	retranscoding[name] = true
+	retranscodingMu.Unlock()
+	defer func() {
+		retranscodingMu.Lock()
+		delete(retranscoding, name)
+		retranscodingMu.Unlock()
+	}()
+
+	currentPath := filepath.Join(AppConfig.ConvertPath, name)
+	meta, found, err := findVideo(name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("video not found")
+	}
+	if meta.Live {
+		return errors.New("can't re-transcode a live stream")
+	}
+	workPath := filepath.Join(AppConfig.ConvertPath, retranscodeDir)
+	if err := os.MkdirAll(workPath, 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(workPath, name)); err != nil {
+		return err
+	}
+
+	source, removeSource, err := findRetranscodeSource(name, workPath)
+	if err != nil {
+		return err
+	}
+	if err := runConversion(source, workPath, name, removeSource, &meta); err != nil {
+		return err
+	}
+	newPath := filepath.Join(workPath, name)
+	if _, err := os.Stat(filepath.Join(newPath, "output.mpd")); err != nil {
+		os.RemoveAll(newPath)
+		return errors.New("conversion failed, the current renditions are kept")
+	}
+	if err := copySidecarFiles(currentPath, newPath); err != nil {
+		os.RemoveAll(newPath)
+		return err
+	}
+	if err := swapVideoFolder(currentPath, newPath); err != nil {
+		os.RemoveAll(newPath)
+		return err
+	}
+	return nil
+}
+
+// findRetranscodeSource returns the retained or archived original of a video or, when missing, a file rebuilt from its highest rendition.
+// The boolean reports whether the file is a temporary one that must be removed after the conversion.
+func findRetranscodeSource(name, workPath string) (string, bool, error) {
+	if original := findOriginal(name); original != "" {
+		return original, false, nil
+	}
+	if meta, err := loadVideoMeta(name); err == nil && meta.ArchiveFile != "" {
+		if _, err := os.Stat(meta.ArchiveFile); err == nil {
+			if !strings.HasSuffix(meta.ArchiveFile, ".gz") {
+				return meta.ArchiveFile, false, nil
+			}
+			restored, err := restoreArchived(meta.ArchiveFile, workPath)
+			if err != nil {
+				return "", false, fmt.Errorf("restoring archived original: %w", err)
+			}
+			return restored, true, nil
+		}
+	}
+
+	convertedPath := filepath.Join(AppConfig.ConvertPath, name)
+	high := filepath.Join(convertedPath, "high_"+name+"_dashinit.mp4")
+	audio := filepath.Join(convertedPath, "audio_"+name+"_dashinit.mp4")
+	// The renditions of private videos are encrypted
+	decrypt := decryptionArgs(name)
+	var inputs []string
+	nInputs := 0
+	for _, f := range []string{high, audio} {
+		if _, err := os.Stat(f); err == nil {
+			inputs = append(append(inputs, decrypt...), "-i", f)
+			nInputs++
+		}
+	}
+	if nInputs == 0 {
+		return "", false, errors.New("neither the original nor a rendition is available")
+	}
+
+	fallback := filepath.Join(workPath, name+"_source.mkv")
+	args := append([]string{"-y"}, inputs...)
+	for i := 0; i < nInputs; i++ {
+		args = append(args, "-map", strconv.Itoa(i))
+	}
+	args = append(args, "-c", "copy", fallback)
+	if err := runConvCommand(appCtx, newConvCommand(appCtx, "/usr/bin/ffmpeg", args...)); err != nil {
+		return "", false, fmt.Errorf("rebuilding source from the renditions: %w", err)
+	}
+	return fallback, true, nil
+}
+
+// findOriginal looks for the original uploaded file of a video in UploadPath.
+func findOriginal(name string) string {
+	matches, _ := filepath.Glob(filepath.Join(AppConfig.UploadPath, name+".*"))
+	matches = append(matches, filepath.Join(AppConfig.UploadPath, name+"_live.ts"))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.IsDir() {
+			return match
+		}
+	}
+	return ""
+}
+
+// listVideoNames returns the IDs of all the videos of the library, except the live streams.
+func listVideoNames() ([]string, error) {
+	var names []string
+	err := forEachVideo(func(videoName string, meta videoMeta) {
+		if !meta.Live {
+			names = append(names, videoName)
+		}
+	})
+	return names, err
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// scanTimeout is the max time of the scan of an upload.
+const scanTimeout = 10 * time.Minute
+
+// Scanner checks an uploaded file for malware. threat is the name of the malware found, empty if the file is clean.
+type Scanner interface {
+	Scan(ctx context.Context, filePath string) (threat string, err error)
+}
+
+// clamdScanner sends the file to a ClamAV daemon with the INSTREAM command, so clamd doesn't need
+// access to UploadPath. The files bigger than StreamMaxLength of clamd.conf are scanned by path with SCAN.
+type clamdScanner struct {
+	network string // "tcp" or "unix"
+	address string
+}
+
+// execScanner runs a command with the path of the file as last argument: exit code 0 means clean,
+// 1 infected (as clamscan), any other code is a scan error.
+type execScanner struct {
+	command []string
+}
+
+// quarantineRecord is saved next to a quarantined file.
+type quarantineRecord struct {
+	OriginalName  string    `json:"originalName,omitempty"`
+	Uploader      string    `json:"uploader,omitempty"`
+	Threat        string    `json:"threat"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+// uploadScanner returns the Scanner set in config.yaml, nil if the uploads are not scanned.
+func uploadScanner() (Scanner, error) {
+	switch AppConfig.Scanner {
+	case "":
+		return nil, nil
+	case "clamd":
+		network, address, ok := strings.Cut(AppConfig.ClamdAddress, ":")
+		if !ok || (network != "tcp" && network != "unix") {
+			return nil, errors.New("invalid ClamdAddress, use tcp:<host>:<port> or unix:<socket path>")
+		}
+		return clamdScanner{network: network, address: address}, nil
+	case "exec":
+		command := strings.Fields(AppConfig.ScanCommand)
+		if len(command) == 0 {
+			return nil, errors.New("ScanCommand is empty")
+		}
+		return execScanner{command: command}, nil
+	}
+	return nil, errors.New("unknown Scanner " + AppConfig.Scanner)
+}
+
+// scanUpload scans a file stored in UploadPath. An infected file is moved to QuarantinePath.
+// A file that can't be scanned is rejected too.
+func scanUpload(filePath string, meta videoMeta) error {
+	scanner, err := uploadScanner()
+	if err != nil {
+		fmt.Println("Error in the scanner configuration:", err)
+		return errors.New("the file could not be scanned for malware")
+	}
+	if scanner == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(appCtx, scanTimeout)
+	defer cancel()
+	threat, err := scanner.Scan(ctx, filePath)
+	if err != nil {
+		fmt.Println("Error scanning", filePath+":", err)
+		return errors.New("the file could not be scanned for malware")
+	}
+	if threat == "" {
+		return nil
+	}
+	fmt.Println("Malware found in", filePath, "uploaded by", meta.Uploader+":", threat)
+	if err := quarantineFile(filePath, meta, threat); err != nil {
+		fmt.Println("Error quarantining", filePath+":", err)
+	}
+	return errors.New("malware found: " + threat)
+}
+
+// quarantineFile moves an infected file to QuarantinePath with a .json record of the upload.
+func quarantineFile(filePath string, meta videoMeta, threat string) error {
+	if err := os.MkdirAll(quarantineDir(), 0700); err != nil {
+		return err
+	}
+	dst := filepath.Join(quarantineDir(), filepath.Base(filePath))
+	if err := os.Rename(filePath, dst); err != nil {
+		// QuarantinePath may be on another file system
+		if err := copyFile(filePath, dst, false); err != nil {
+			return err
+		}
+		if err := os.Remove(filePath); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dst, 0600); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(quarantineRecord{
+		OriginalName:  meta.OriginalName,
+		Uploader:      meta.Uploader,
+		Threat:        threat,
+		QuarantinedAt: time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst+".json", data, 0600)
+}
+
+// quarantineDir returns the folder of the infected files.
+func quarantineDir() string {
+	if AppConfig.QuarantinePath == "" {
+		return "./quarantine"
+	}
+	return AppConfig.QuarantinePath
+}
+
+// errClamdSizeLimit is returned by INSTREAM for the files bigger than StreamMaxLength of clamd.conf.
+var errClamdSizeLimit = errors.New("clamd: INSTREAM size limit exceeded")
+
+func (s clamdScanner) Scan(ctx context.Context, filePath string) (string, error) {
+	threat, err := s.scanStream(ctx, filePath)
+	if errors.Is(err, errClamdSizeLimit) {
+		// clamd can still read the file itself if it shares the file system
+		fmt.Println("File bigger than StreamMaxLength of clamd, scanning it by path:", filePath)
+		return s.scanPath(ctx, filePath)
+	}
+	return threat, err
+}
+
+// scanStream sends the file to clamd with INSTREAM.
+func (s clamdScanner) scanStream(ctx context.Context, filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	// The file is sent in chunks prefixed by their length, a zero length ends the stream
+	buf := make([]byte, 64*1024)
+	size := make([]byte, 4)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(append(size, buf[:n]...)); err != nil {
+				// clamd replies and closes the connection when the stream exceeds StreamMaxLength
+				if reply, readErr := readClamdReply(conn); readErr == nil && strings.Contains(reply, "size limit exceeded") {
+					return "", errClamdSizeLimit
+				}
+				return "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(reply, "size limit exceeded") {
+		return "", errClamdSizeLimit
+	}
+	return parseClamdReply(reply)
+}
+
+// scanPath asks clamd to scan the file by its path with SCAN, clamd must be able to read it.
+func (s clamdScanner) scanPath(ctx context.Context, filePath string) (string, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("zSCAN " + absPath + "\x00")); err != nil {
+		return "", err
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return "", err
+	}
+	return parseClamdReply(reply)
+}
+
+func (s clamdScanner) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// readClamdReply reads the null terminated reply of clamd.
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// parseClamdReply parses "<stream or path>: OK", "<stream or path>: <threat> FOUND" or "<message> ERROR".
+func parseClamdReply(reply string) (string, error) {
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		threat := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.LastIndex(threat, ": "); i >= 0 {
+			threat = threat[i+2:]
+		}
+		return threat, nil
+	}
+	return "", errors.New("clamd: " + reply)
+}
+
+func (s execScanner) Scan(ctx context.Context, filePath string) (string, error) {
+	args := append(s.command[1:len(s.command):len(s.command)], filePath)
+	out, err := exec.CommandContext(ctx, s.command[0], args...).CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		// clamscan like output: "<file>: <threat> FOUND"
+		for _, line := range strings.Split(string(out), "\n") {
+			if line = strings.TrimSpace(line); strings.HasSuffix(line, " FOUND") {
+				line = strings.TrimPrefix(line, filePath+": ")
+				return strings.TrimSuffix(line, " FOUND"), nil
+			}
+		}
+		return "reported by " + filepath.Base(s.command[0]), nil
+	}
+	return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+}
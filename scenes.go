@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+const (
+	suggestedChaptersFileName = "chapters_suggested.json"
+	scenesDir                 = "scenes" // thumbnails of the suggested chapters, inside the video folder
+)
+
+var (
+	scenePtsTime      = regexp.MustCompile(`pts_time:([0-9.]+)`)
+	detectingScenes   = make(map[string]bool) // videos with a scene detection queued or running
+	detectingScenesMu sync.Mutex
+)
+
+type suggestedChapter struct {
+	chapter
+	Thumbnail string `json:"thumbnail"` // file name in the scenes folder
+}
+
+// queueSceneDetection queues a low priority job proposing chapters from the scene changes of a converted video,
+// one at a time per video. Private videos are skipped: the thumbnails would be plain frames served by
+// /converted/ to anyone.
+func queueSceneDetection(convertPath, videoName string) error {
+	meta, _, err := findVideo(videoName)
+	if err != nil {
+		return err
+	}
+	if meta.Private {
+		return errors.New("private video")
+	}
+	source := filepath.Join(convertPath, videoName, "low_"+videoName+"_dashinit.mp4")
+	if _, err := os.Stat(source); err != nil {
+		return errors.New("low rendition not found")
+	}
+	detectingScenesMu.Lock()
+	if detectingScenes[videoName] {
+		detectingScenesMu.Unlock()
+		return errors.New("a scene detection is already queued or running")
+	}
+	detectingScenes[videoName] = true
+	detectingScenesMu.Unlock()
+
+	startConvertWorkers.Do(func() {
+		go convertVideo(videoQuality)
+	})
+	quequelen.Add(1)
+	done := make(chan struct{})
+	go func() {
+		videoQuality <- VideoParams{videoPath: source, videoName: videoName, outputDir: filepath.Join(convertPath, videoName), sceneDetect: true, lowPriority: true, done: done}
+		<-done
+		detectingScenesMu.Lock()
+		delete(detectingScenes, videoName)
+		detectingScenesMu.Unlock()
+	}()
+	return nil
+}
+
+// detectScenes runs the ffmpeg scene detection on params.videoPath and saves the suggested chapters with their thumbnails.
+func detectScenes(ctx context.Context, params VideoParams) error {
+	threshold := AppConfig.SceneThreshold
+	if threshold == "" {
+		threshold = "0.4"
+	}
+	decrypt := decryptionArgs(params.videoName)
+	cmd := newConvCommand(ctx, "/usr/bin/ffmpeg", append(decrypt, "-i", params.videoPath, "-an", "-vf", "select='gt(scene,"+threshold+")',showinfo", "-f", "null", "-")...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := runConvCommand(ctx, cmd); err != nil {
+		return fmt.Errorf("scene detection of %s: %w", params.videoName, err)
+	}
+
+	minGap := float64(AppConfig.SceneMinGap)
+	starts := []float64{0}
+	for _, match := range scenePtsTime.FindAllSubmatch(stderr.Bytes(), -1) {
+		t, err := strconv.ParseFloat(string(match[1]), 64)
+		if err != nil || t-starts[len(starts)-1] < minGap {
+			continue
+		}
+		starts = append(starts, t)
+		if AppConfig.SceneMaxChapters > 0 && len(starts) >= AppConfig.SceneMaxChapters {
+			break
+		}
+	}
+	if len(starts) < 2 {
+		fmt.Println("No scene change found in", params.videoName)
+		return nil
+	}
+
+	thumbsPath := filepath.Join(params.outputDir, scenesDir)
+	if err := os.RemoveAll(thumbsPath); err != nil {
+		return err
+	}
+	if err := os.Mkdir(thumbsPath, 0755); err != nil {
+		return err
+	}
+	var suggestions []suggestedChapter
+	for i, start := range starts {
+		thumbnail := fmt.Sprintf("scene_%03d.jpeg", i+1)
+		// A frame just after the cut represents the scene better than the cut itself
+		args := append([]string{"-ss", strconv.FormatFloat(start+0.5, 'f', 3, 64)}, decrypt...)
+		cmd := newConvCommand(ctx, "/usr/bin/ffmpeg", append(args, "-i", params.videoPath, "-frames:v", "1", "-vf", "scale=320:-2", "-f", "image2", filepath.Join(thumbsPath, thumbnail))...)
+		if err := runConvCommand(ctx, cmd); err != nil {
+			fmt.Println("Error creating scene thumbnail:", err)
+			thumbnail = ""
+		}
+		suggestions = append(suggestions, suggestedChapter{chapter: chapter{Start: start, Title: "Scene " + strconv.Itoa(i+1)}, Thumbnail: thumbnail})
+	}
+	data, err := json.MarshalIndent(suggestions, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println("Scene detection end:", params.videoName, len(suggestions), "chapters suggested")
+	return ioutil.WriteFile(filepath.Join(params.outputDir, suggestedChaptersFileName), data, 0644)
+}
+
+// loadSuggestedChapters reads the chapters proposed by the scene detection of a video.
+func loadSuggestedChapters(convertPath, videoName string) ([]suggestedChapter, error) {
+	var suggestions []suggestedChapter
+	data, err := ioutil.ReadFile(filepath.Join(convertPath, videoName, suggestedChaptersFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &suggestions)
+	return suggestions, err
+}
+
+// discardSuggestedChapters removes the suggested chapters and their thumbnails.
+func discardSuggestedChapters(convertPath, videoName string) error {
+	if err := os.Remove(filepath.Join(convertPath, videoName, suggestedChaptersFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(convertPath, videoName, scenesDir))
+}
+
+// discardPrivateSceneSuggestions removes the scene thumbnails made for private videos by older versions.
+func discardPrivateSceneSuggestions() {
+	err := forEachVideo(func(videoName string, meta videoMeta) {
+		if meta.Private {
+			if err := discardSuggestedChapters(AppConfig.ConvertPath, videoName); err != nil {
+				fmt.Println(err)
+			}
+		}
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// sceneChaptersHandler accepts, discards or requests the scene based chapter suggestions of a video.
+func sceneChaptersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	videoname := r.URL.Query().Get("videoname")
+	if !isSafeFileName(videoname) {
+		sendError(w, r, "Invalid video name")
+		return
+	}
+	meta, found, err := findVideo(videoname)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if !found {
+		sendError(w, r, "Video not found: "+videoname)
+		return
+	}
+	if !canEditVideo(r, meta) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "accept":
+		suggestions, err := loadSuggestedChapters(AppConfig.ConvertPath, videoname)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		var chapters []chapter
+		for _, s := range suggestions {
+			chapters = append(chapters, s.chapter)
+		}
+		if err := saveChapters(AppConfig.ConvertPath, videoname, chapters); err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		if err := discardSuggestedChapters(AppConfig.ConvertPath, videoname); err != nil {
+			fmt.Println(err)
+		}
+	case "discard":
+		if err := discardSuggestedChapters(AppConfig.ConvertPath, videoname); err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+	case "detect":
+		if meta.Private {
+			sendError(w, r, "Chapter suggestions are not available for private videos")
+			return
+		}
+		if err := queueSceneDetection(AppConfig.ConvertPath, videoname); err != nil {
+			sendError(w, r, "Chapter suggestions not started: "+err.Error())
+			return
+		}
+	default:
+		sendError(w, r, "Invalid action")
+		return
+	}
+	http.Redirect(w, r, "/chapters?videoname="+videoname, http.StatusSeeOther)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// convWindow is a time window during which the conversions run at full concurrency,
+// e.g. "Mon-Fri 20:00-07:00". A window ending before its start continues on the next day.
+type convWindow struct {
+	days  [7]bool // indexed by time.Weekday
+	start int     // minutes from midnight
+	end   int
+}
+
+// convScheduler limits the number of conversion jobs running at the same time according to ConvWindows.
+// Waiting jobs are started in FIFO order, low priority jobs only when no other job is waiting.
+// The jobs bypassing the schedule go first and are limited only by ConvWorkers, also outside the windows.
+type convScheduler struct {
+	mu            sync.Mutex
+	running       int
+	waitingBypass []chan struct{}
+	waiting       []chan struct{}
+	waitingLow    []chan struct{}
+	ticker        sync.Once
+}
+
+var convSchedule = &convScheduler{}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseConvWindows parses a list of windows separated by ";", each one in the form
+// "[Days] HH:MM-HH:MM" where Days is a comma separated list of days or day ranges (Mon-Fri,Sun).
+// Without Days the window applies to every day.
+func parseConvWindows(spec string) ([]convWindow, error) {
+	var windows []convWindow
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Fields(part)
+		var w convWindow
+		hours := fields[len(fields)-1]
+		switch len(fields) {
+		case 1:
+			for i := range w.days {
+				w.days[i] = true
+			}
+		case 2:
+			for _, days := range strings.Split(fields[0], ",") {
+				from, to, isRange := strings.Cut(strings.ToLower(days), "-")
+				first, ok := weekdays[from]
+				if !ok {
+					return nil, fmt.Errorf("invalid day %q in %q", from, part)
+				}
+				last := first
+				if isRange {
+					if last, ok = weekdays[to]; !ok {
+						return nil, fmt.Errorf("invalid day %q in %q", to, part)
+					}
+				}
+				for d := first; ; d = (d + 1) % 7 {
+					w.days[d] = true
+					if d == last {
+						break
+					}
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid window %q", part)
+		}
+		start, end, ok := strings.Cut(hours, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid hours %q in %q", hours, part)
+		}
+		var err error
+		if w.start, err = parseClock(start); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseClock(end); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseClock converts "HH:MM" to minutes from midnight, "24:00" is allowed as end of the day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// contains reports whether t is inside the window.
+func (w convWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	if w.end > w.start {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+	// Window crossing midnight
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// inConvWindow reports whether t is inside the configured conversion windows.
+// Without windows (or with invalid ones) conversions always run at full concurrency.
+func inConvWindow(t time.Time) bool {
+	windows, err := parseConvWindows(AppConfig.ConvWindows)
+	if err != nil || len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// convWorkers returns the number of jobs allowed to run in the conversion windows.
+func convWorkers() int {
+	if AppConfig.ConvWorkers < 1 {
+		return 1
+	}
+	return AppConfig.ConvWorkers
+}
+
+// limit returns the number of jobs allowed to run now.
+func (s *convScheduler) limit() int {
+	workers := convWorkers()
+	if inConvWindow(time.Now()) {
+		return workers
+	}
+	if AppConfig.ConvOffPeakWorkers < workers {
+		return AppConfig.ConvOffPeakWorkers
+	}
+	return workers
+}
+
+// acquire waits for a free slot. The jobs bypassing the schedule wait only for one of the ConvWorkers slots.
+// It returns false, without a slot, if ctx is done first: the job leaves the queue.
+func (s *convScheduler) acquire(ctx context.Context, bypass, lowPriority bool) bool {
+	s.ticker.Do(func() {
+		// Re-evaluate the waiting jobs when a window opens
+		go func() {
+			for range time.NewTicker(time.Minute).C {
+				s.mu.Lock()
+				s.dispatch()
+				s.mu.Unlock()
+			}
+		}()
+	})
+
+	s.mu.Lock()
+	ready := make(chan struct{})
+	switch {
+	case bypass:
+		s.waitingBypass = append(s.waitingBypass, ready)
+	case lowPriority:
+		s.waitingLow = append(s.waitingLow, ready)
+	default:
+		s.waiting = append(s.waiting, ready)
+	}
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if removeWaiter(&s.waitingBypass, ready) || removeWaiter(&s.waiting, ready) || removeWaiter(&s.waitingLow, ready) {
+		return false
+	}
+	// Started meanwhile: give the slot back
+	s.running--
+	s.dispatch()
+	return false
+}
+
+// removeWaiter removes ready from the queue, it reports whether it was there.
+func removeWaiter(queue *[]chan struct{}, ready chan struct{}) bool {
+	for i, waiter := range *queue {
+		if waiter == ready {
+			*queue = append((*queue)[:i], (*queue)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// release frees the slot of a completed job.
+func (s *convScheduler) release() {
+	s.mu.Lock()
+	s.running--
+	s.dispatch()
+	s.mu.Unlock()
+}
+
+// dispatch starts the waiting jobs while slots are available. It must be called with s.mu held.
+func (s *convScheduler) dispatch() {
+	for len(s.waitingBypass) > 0 && s.running < convWorkers() {
+		close(s.waitingBypass[0])
+		s.waitingBypass = s.waitingBypass[1:]
+		s.running++
+	}
+	limit := s.limit()
+	for len(s.waiting) > 0 && s.running < limit {
+		close(s.waiting[0])
+		s.waiting = s.waiting[1:]
+		s.running++
+	}
+	for len(s.waitingLow) > 0 && s.running < limit {
+		close(s.waitingLow[0])
+		s.waitingLow = s.waitingLow[1:]
+		s.running++
+	}
+}
+
+// status describes the current state of the schedule for the queue page.
+func (s *convScheduler) status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit := s.limit()
+	state := "Conversion window open"
+	if !inConvWindow(time.Now()) {
+		state = "Outside the conversion windows (" + AppConfig.ConvWindows + ")"
+		if limit == 0 {
+			state += ": conversions paused"
+		} else {
+			state += ": reduced concurrency"
+		}
+	}
+	return fmt.Sprintf("%s. Running jobs: %d, max concurrent jobs: %d, waiting: %d", state, s.running, limit, len(s.waitingBypass)+len(s.waiting)+len(s.waitingLow))
+}
+
+// isPriorityUploader reports whether the jobs of the given user bypass the conversion schedule.
+func isPriorityUploader(username string) bool {
+	if AppConfig.ConvPriorityRole == "" || username == "" {
+		return false
+	}
+	for _, user := range users {
+		if user.Username == username {
+			return user.Role == AppConfig.ConvPriorityRole
+		}
+	}
+	return false
+}
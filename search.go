@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The full-text index is kept in the database next to the videos: bucketSearchIndex maps every term of
+// a video to its weighted frequency, bucketSearchDocs the video to its terms and length, to update the
+// index and to rank the results with BM25, and bucketSearchStats keeps the totals over all the videos,
+// so that a search reads only the postings of its terms.
+var (
+	bucketSearchIndex = []byte("searchIndex") // term + "\x00" + video ID -> weighted frequency
+	bucketSearchDocs  = []byte("searchDocs")  // video ID -> searchDoc
+	bucketSearchStats = []byte("searchStats") // searchStatsKey -> searchStats
+)
+
+const searchStatsKey = "stats"
+
+// Weights of the fields of a video in the index
+const (
+	titleWeight       = 3
+	tagWeight         = 2
+	descriptionWeight = 1
+	uploaderWeight    = 1
+)
+
+// Limits of a search
+const (
+	maxSearchLen   = 200 // characters of the query
+	maxSearchTerms = 10
+	maxTermLen     = 40 // characters, longer words are not indexed
+)
+
+// BM25 parameters, prefixWeight is the weight of a term matched by prefix only.
+const (
+	bm25K1       = 1.2
+	bm25B        = 0.75
+	prefixWeight = 0.5
+)
+
+// searchDoc is a video in the index.
+type searchDoc struct {
+	Terms  []string `json:"terms"`
+	Length int      `json:"length"` // sum of the weighted frequencies
+}
+
+// searchStats are the totals of the index, for the normalization of the lengths in BM25.
+type searchStats struct {
+	Docs   int `json:"docs"`
+	Length int `json:"length"` // sum of the lengths of the videos
+}
+
+// searchQuery is a search of the library, from the query string of /search and /api/search.
+type searchQuery struct {
+	Text     string // words to find, each one matching also the words it is a prefix of
+	Tag      string
+	Uploader string
+	Type     string // video, audio, live or "" (any)
+	From     string // upload date, YYYY-MM-DD
+	To       string
+	Sort     string // relevance, newest, oldest or views
+	Page     int
+
+	from, to time.Time
+}
+
+// searchResult is a video found by a search.
+type searchResult struct {
+	ID         string    `json:"id"`
+	Title      string    `json:"title"`
+	Uploader   string    `json:"uploader,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	Duration   float64   `json:"duration,omitempty"`
+	Views      int64     `json:"views"`
+	AudioOnly  bool      `json:"audioOnly,omitempty"`
+	Live       bool      `json:"live,omitempty"`
+	Score      float64   `json:"score,omitempty"`
+}
+
+// createSearchIndex is the migration adding the full-text index of the videos already in the library.
+func createSearchIndex(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(bucketSearchIndex); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists(bucketSearchDocs); err != nil {
+		return err
+	}
+	videos := make(map[string]videoMeta)
+	err := tx.Bucket(bucketVideos).ForEach(func(k, v []byte) error {
+		var meta videoMeta
+		if err := json.Unmarshal(v, &meta); err != nil {
+			return err
+		}
+		videos[string(k)] = meta
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id, meta := range videos {
+		if err := indexVideo(tx, id, meta); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Indexed", len(videos), "videos for the search")
+	return nil
+}
+
+// createSearchStats is the migration adding the totals of the index built by createSearchIndex.
+func createSearchStats(tx *bolt.Tx) error {
+	stats, err := tx.CreateBucketIfNotExists(bucketSearchStats)
+	if err != nil {
+		return err
+	}
+	var total searchStats
+	err = tx.Bucket(bucketSearchDocs).ForEach(func(k, v []byte) error {
+		var doc searchDoc
+		if err := json.Unmarshal(v, &doc); err != nil {
+			return err
+		}
+		total.Docs++
+		total.Length += doc.Length
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return putJSON(stats, searchStatsKey, total)
+}
+
+// updateSearchStats adds docs videos of the given total length to the totals of the index, negative to remove them.
+// It does nothing before createSearchStats has run.
+func updateSearchStats(tx *bolt.Tx, docs, length int) error {
+	stats := tx.Bucket(bucketSearchStats)
+	if stats == nil {
+		return nil
+	}
+	var total searchStats
+	if err := getJSON(stats, searchStatsKey, &total); err != nil {
+		return err
+	}
+	total.Docs += docs
+	total.Length += length
+	return putJSON(stats, searchStatsKey, total)
+}
+
+// indexVideo replaces the terms of a video in the index. It does nothing before createSearchIndex has run.
+func indexVideo(tx *bolt.Tx, videoName string, meta videoMeta) error {
+	index, docs := tx.Bucket(bucketSearchIndex), tx.Bucket(bucketSearchDocs)
+	if index == nil || docs == nil {
+		return nil
+	}
+	if err := unindexVideo(tx, videoName); err != nil {
+		return err
+	}
+
+	freqs := make(map[string]int)
+	add := func(text string, weight int) {
+		for _, term := range tokenize(text) {
+			freqs[term] += weight
+		}
+	}
+	add(meta.Title, titleWeight)
+	for _, tag := range meta.Tags {
+		add(tag, tagWeight)
+	}
+	add(meta.Description, descriptionWeight)
+	add(meta.Uploader, uploaderWeight)
+
+	var doc searchDoc
+	for term, freq := range freqs {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(freq))
+		if err := index.Put(postingKey(term, videoName), value); err != nil {
+			return err
+		}
+		doc.Terms = append(doc.Terms, term)
+		doc.Length += freq
+	}
+	sort.Strings(doc.Terms)
+	if err := putJSON(docs, videoName, doc); err != nil {
+		return err
+	}
+	return updateSearchStats(tx, 1, doc.Length)
+}
+
+// unindexVideo removes a video from the index.
+func unindexVideo(tx *bolt.Tx, videoName string) error {
+	index, docs := tx.Bucket(bucketSearchIndex), tx.Bucket(bucketSearchDocs)
+	if index == nil || docs == nil {
+		return nil
+	}
+	data := docs.Get([]byte(videoName))
+	if data == nil {
+		return nil
+	}
+	var doc searchDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	for _, term := range doc.Terms {
+		if err := index.Delete(postingKey(term, videoName)); err != nil {
+			return err
+		}
+	}
+	if err := docs.Delete([]byte(videoName)); err != nil {
+		return err
+	}
+	return updateSearchStats(tx, -1, -doc.Length)
+}
+
+func postingKey(term, videoName string) []byte {
+	return []byte(term + "\x00" + videoName)
+}
+
+// tokenize splits a text in lower case words of letters and digits.
+func tokenize(text string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if utf8.RuneCountInString(word) <= maxTermLen {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// parseSearchQuery reads a search from the query string.
+func parseSearchQuery(values url.Values) (searchQuery, error) {
+	q := searchQuery{
+		Text:     strings.TrimSpace(values.Get("q")),
+		Tag:      strings.ToLower(strings.TrimSpace(values.Get("tag"))),
+		Uploader: strings.TrimSpace(values.Get("uploader")),
+		Type:     values.Get("type"),
+		From:     values.Get("from"),
+		To:       values.Get("to"),
+		Sort:     values.Get("sort"),
+		Page:     1,
+	}
+	if utf8.RuneCountInString(q.Text) > maxSearchLen {
+		return q, errors.New("The search can't be longer than " + strconv.Itoa(maxSearchLen) + " characters")
+	}
+	switch q.Type {
+	case "", "video", "audio", "live":
+	default:
+		return q, errors.New("Invalid type: use video, audio or live")
+	}
+	switch q.Sort {
+	case "":
+		q.Sort = "relevance"
+		if len(tokenize(q.Text)) == 0 {
+			q.Sort = "newest"
+		}
+	case "relevance", "newest", "oldest", "views":
+	default:
+		return q, errors.New("Invalid sort: use relevance, newest, oldest or views")
+	}
+	var err error
+	if q.From != "" {
+		if q.from, err = time.ParseInLocation("2006-01-02", q.From, time.Local); err != nil {
+			return q, errors.New("Invalid from date, use YYYY-MM-DD")
+		}
+	}
+	if q.To != "" {
+		if q.to, err = time.ParseInLocation("2006-01-02", q.To, time.Local); err != nil {
+			return q, errors.New("Invalid to date, use YYYY-MM-DD")
+		}
+		q.to = q.to.AddDate(0, 0, 1) // the whole day
+	}
+	if page, err := strconv.Atoi(values.Get("page")); err == nil && page > 0 {
+		q.Page = page
+	}
+	return q, nil
+}
+
+// matches reports whether a video passes the filters of the search.
+func (q searchQuery) matches(meta videoMeta) bool {
+	if q.Uploader != "" && meta.Uploader != q.Uploader {
+		return false
+	}
+	if q.Tag != "" && !hasTag(meta, q.Tag) {
+		return false
+	}
+	switch q.Type {
+	case "video":
+		if meta.AudioOnly || meta.Live {
+			return false
+		}
+	case "audio":
+		if !meta.AudioOnly {
+			return false
+		}
+	case "live":
+		if !meta.Live {
+			return false
+		}
+	}
+	if !q.from.IsZero() && meta.UploadedAt.Before(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && !meta.UploadedAt.Before(q.to) {
+		return false
+	}
+	return true
+}
+
+// searchVideos returns a page of the videos matching the search for which visible returns true,
+// and the number of matching videos. Every word of the text must be found.
+func searchVideos(q searchQuery, visible func(meta videoMeta) bool) ([]searchResult, int, error) {
+	var results []searchResult
+	err := db.View(func(tx *bolt.Tx) error {
+		var scores map[string]float64
+		if terms := tokenize(q.Text); len(terms) > 0 {
+			if len(terms) > maxSearchTerms {
+				terms = terms[:maxSearchTerms]
+			}
+			var err error
+			if scores, err = scoreTerms(tx, terms); err != nil {
+				return err
+			}
+		}
+
+		videos, views := tx.Bucket(bucketVideos), tx.Bucket(bucketViews)
+		add := func(id []byte, meta videoMeta) {
+			if !q.matches(meta) || !visible(meta) {
+				return
+			}
+			result := searchResult{
+				ID:         string(id),
+				Title:      meta.Title,
+				Uploader:   meta.Uploader,
+				Tags:       meta.Tags,
+				UploadedAt: meta.UploadedAt,
+				Duration:   meta.Duration,
+				AudioOnly:  meta.AudioOnly,
+				Live:       meta.Live,
+				Score:      scores[string(id)],
+			}
+			if result.Title == "" {
+				result.Title = result.ID
+			}
+			var view viewRecord
+			if data := views.Get(id); data != nil && json.Unmarshal(data, &view) == nil {
+				result.Views = view.Views
+			}
+			results = append(results, result)
+		}
+		if scores == nil {
+			return videos.ForEach(func(k, v []byte) error {
+				var meta videoMeta
+				if err := json.Unmarshal(v, &meta); err == nil {
+					add(k, meta)
+				}
+				return nil
+			})
+		}
+		for id := range scores {
+			var meta videoMeta
+			if data := videos.Get([]byte(id)); data != nil && json.Unmarshal(data, &meta) == nil {
+				add([]byte(id), meta)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		switch {
+		case q.Sort == "relevance" && a.Score != b.Score:
+			return a.Score > b.Score
+		case q.Sort == "views" && a.Views != b.Views:
+			return a.Views > b.Views
+		case q.Sort == "oldest":
+			return a.UploadedAt.Before(b.UploadedAt)
+		}
+		return a.UploadedAt.After(b.UploadedAt)
+	})
+	total := len(results)
+	start := (q.Page - 1) * videosPerPage()
+	if start >= total {
+		return nil, total, nil
+	}
+	end := start + videosPerPage()
+	if end > total {
+		end = total
+	}
+	return results[start:end], total, nil
+}
+
+// scoreTerms returns the BM25 score of the videos containing all the terms, as whole words or as prefixes.
+func scoreTerms(tx *bolt.Tx, terms []string) (map[string]float64, error) {
+	var total searchStats
+	if err := getJSON(tx.Bucket(bucketSearchStats), searchStatsKey, &total); err != nil || total.Docs <= 0 {
+		return map[string]float64{}, err
+	}
+	n := float64(total.Docs)
+	avgLength := float64(total.Length) / n
+	// Length of the videos found, read once per video
+	docs := tx.Bucket(bucketSearchDocs)
+	lengths := make(map[string]float64)
+	docLength := func(id string) float64 {
+		if length, ok := lengths[id]; ok {
+			return length
+		}
+		var doc searchDoc
+		if data := docs.Get([]byte(id)); data != nil {
+			json.Unmarshal(data, &doc)
+		}
+		lengths[id] = float64(doc.Length)
+		return lengths[id]
+	}
+
+	var scores map[string]float64
+	for _, term := range terms {
+		termScores := make(map[string]float64)
+		// The postings of a term are contiguous, as are the terms starting with the same prefix
+		c := tx.Bucket(bucketSearchIndex).Cursor()
+		k, v := c.Seek([]byte(term))
+		for k != nil && bytes.HasPrefix(k, []byte(term)) {
+			sep := bytes.IndexByte(k, 0)
+			indexed := string(k[:sep])
+			postings := make(map[string]float64)
+			for ; k != nil && bytes.HasPrefix(k, []byte(indexed+"\x00")); k, v = c.Next() {
+				postings[string(k[sep+1:])] = float64(binary.BigEndian.Uint32(v))
+			}
+			df := float64(len(postings))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			weight := 1.0
+			if indexed != term {
+				weight = prefixWeight
+			}
+			for id, tf := range postings {
+				norm := tf + bm25K1*(1-bm25B+bm25B*docLength(id)/avgLength)
+				score := weight * idf * tf * (bm25K1 + 1) / norm
+				if score > termScores[id] {
+					termScores[id] = score
+				}
+			}
+		}
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for id, score := range scores {
+			if termScore, ok := termScores[id]; ok {
+				scores[id] = score + termScore
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores, nil
+}
+
+// searchHandler shows the search page of the library.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if AppConfig.VideoOnlyForUsers && !adminAuthenticated(r) && !userAuthenticated(r) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	q, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	results, total, err := searchVideos(q, func(meta videoMeta) bool {
+		return canViewVideo(r, meta)
+	})
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	p := &PageSearch{Query: q, Results: results, Total: total}
+	pageURL := func(page int) string {
+		values := r.URL.Query()
+		values.Set("page", strconv.Itoa(page))
+		return "/search?" + values.Encode()
+	}
+	if q.Page > 1 {
+		p.PrevURL = pageURL(q.Page - 1)
+	}
+	if q.Page*videosPerPage() < total {
+		p.NextURL = pageURL(q.Page + 1)
+	}
+	renderTemplate(w, "search", p)
+}
+
+// searchAPIHandler returns the results of a search as JSON.
+func searchAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if AppConfig.VideoOnlyForUsers && !adminAuthenticated(r) && !userAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Login required"})
+		return
+	}
+	q, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	results, total, err := searchVideos(q, func(meta videoMeta) bool {
+		return canViewVideo(r, meta)
+	})
+	if err != nil {
+		fmt.Println("Error searching:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Search failed"})
+		return
+	}
+	if results == nil {
+		results = []searchResult{}
+	}
+	response := struct {
+		Query   string         `json:"query"`
+		Sort    string         `json:"sort"`
+		Page    int            `json:"page"`
+		PerPage int            `json:"perPage"`
+		Total   int            `json:"total"`
+		Results []searchResult `json:"results"`
+	}{q.Text, q.Sort, q.Page, videosPerPage(), total, results}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("Error sending search results:", err)
+	}
+}
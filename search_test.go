@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// saveTestVideos saves videos uploaded one minute apart, in the order of the titles.
+func saveTestVideos(t *testing.T, titles map[string]string) {
+	t.Helper()
+	ids := make([]string, 0, len(titles))
+	for id := range titles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for i, id := range ids {
+		meta := videoMeta{Title: titles[id], UploadedAt: time.Date(2026, 1, 1, 0, i, 0, 0, time.UTC)}
+		if err := saveVideoMeta(id, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// searchIDs returns the IDs found by a search of text, by relevance.
+func searchIDs(t *testing.T, text string) []string {
+	t.Helper()
+	results, _, err := searchVideos(searchQuery{Text: text, Sort: "relevance", Page: 1}, func(videoMeta) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, result := range results {
+		ids = append(ids, result.ID)
+	}
+	return ids
+}
+
+// checkSearchIndex compares the postings, the documents and the totals of the index with the videos.
+func checkSearchIndex(t *testing.T) {
+	t.Helper()
+	err := db.View(func(tx *bolt.Tx) error {
+		docs := make(map[string]searchDoc)
+		var total searchStats
+		err := tx.Bucket(bucketSearchDocs).ForEach(func(k, v []byte) error {
+			var doc searchDoc
+			if err := json.Unmarshal(v, &doc); err != nil {
+				return err
+			}
+			if tx.Bucket(bucketVideos).Get(k) == nil {
+				t.Errorf("document of the missing video %s", k)
+			}
+			docs[string(k)] = doc
+			total.Docs++
+			total.Length += doc.Length
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var stats searchStats
+		if err := getJSON(tx.Bucket(bucketSearchStats), searchStatsKey, &stats); err != nil {
+			return err
+		}
+		if stats != total {
+			t.Errorf("stats %+v, the documents sum to %+v", stats, total)
+		}
+
+		postings := 0
+		err = tx.Bucket(bucketSearchIndex).ForEach(func(k, v []byte) error {
+			term, id, _ := bytes.Cut(k, []byte{0})
+			doc, ok := docs[string(id)]
+			if i := sort.SearchStrings(doc.Terms, string(term)); !ok || i == len(doc.Terms) || doc.Terms[i] != string(term) {
+				t.Errorf("posting %q of %s not in its document", term, id)
+			}
+			postings++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		terms := 0
+		for _, doc := range docs {
+			terms += len(doc.Terms)
+		}
+		if postings != terms {
+			t.Errorf("%d postings for %d terms in the documents", postings, terms)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchExactBeatsPrefix(t *testing.T) {
+	openTestStore(t, t.TempDir())
+	saveTestVideos(t, map[string]string{
+		"conferenceVd": "Conference talk",
+		"confVideo001": "Conf talk",
+		"otherVideo01": "Keynote",
+	})
+	got := searchIDs(t, "conf")
+	if len(got) != 2 || got[0] != "confVideo001" || got[1] != "conferenceVd" {
+		t.Errorf("search conf = %v, want the exact match before the prefix match", got)
+	}
+}
+
+func TestSearchAllTerms(t *testing.T) {
+	openTestStore(t, t.TempDir())
+	saveTestVideos(t, map[string]string{
+		"goConference": "Go conference",
+		"goMeetup0001": "Go meetup",
+		"rustConf0001": "Rust conference",
+	})
+	for text, want := range map[string]string{
+		"go conf":    "goConference",
+		"conf rust":  "rustConf0001",
+		"meetup GO!": "goMeetup0001",
+	} {
+		if got := searchIDs(t, text); len(got) != 1 || got[0] != want {
+			t.Errorf("search %q = %v, want only %s", text, got, want)
+		}
+	}
+	if got := searchIDs(t, "go rust"); len(got) != 0 {
+		t.Errorf("search go rust = %v, want nothing", got)
+	}
+}
+
+func TestSearchIndexAfterUpdateAndDelete(t *testing.T) {
+	openTestStore(t, t.TempDir())
+	saveTestVideos(t, map[string]string{
+		"video0000001": "Holiday in the mountains",
+		"video0000002": "Mountains by night",
+		"video0000003": "City walk",
+	})
+	checkSearchIndex(t)
+
+	err := updateVideoMeta("video0000001", func(meta *videoMeta) {
+		meta.Title = "Holiday at the sea"
+		meta.Tags = []string{"summer"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteVideoRecord("video0000003"); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteVideoRecord("notAVideo001"); err != nil {
+		t.Fatal(err)
+	}
+	checkSearchIndex(t)
+
+	if got := searchIDs(t, "mountains"); len(got) != 1 || got[0] != "video0000002" {
+		t.Errorf("search mountains = %v, want only video0000002", got)
+	}
+	if got := searchIDs(t, "summer sea"); len(got) != 1 || got[0] != "video0000001" {
+		t.Errorf("search summer sea = %v, want only video0000001", got)
+	}
+	if got := searchIDs(t, "city"); len(got) != 0 {
+		t.Errorf("search city = %v, want nothing after the deletion", got)
+	}
+}
+
+func TestCreateSearchStats(t *testing.T) {
+	openTestStore(t, t.TempDir())
+	saveTestVideos(t, map[string]string{
+		"video0000001": "First video",
+		"video0000002": "Second video with a longer title",
+	})
+	// The totals of an index built before the migration
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucketSearchStats); err != nil {
+			return err
+		}
+		return createSearchStats(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSearchIndex(t)
+}
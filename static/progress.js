@@ -0,0 +1,55 @@
+/**
+ * Follows the conversion of one or more videos with the Server-Sent Events of /progress.
+ * onEvent is called with {video, stage, position, percent, message} for every event;
+ * the stream is closed when all the videos are ready or failed.
+ */
+var PROGRESS_LABELS = {
+    downloading: "Downloading",
+    queued: "Waiting in the conversion queue",
+    converting: "Converting",
+    packaging: "Packaging",
+    ready: "Ready",
+    failed: "Failed"
+};
+
+function watchProgress(videoNames, onEvent) {
+    var pending = {};
+    var query = videoNames.map(function (name) {
+        pending[name] = true;
+        return "videoname=" + encodeURIComponent(name);
+    }).join("&");
+    var source = new EventSource("/progress?" + query);
+
+    source.addEventListener("progress", function (e) {
+        var event = JSON.parse(e.data);
+        if (event.stage === "ready" || event.stage === "failed") {
+            delete pending[event.video];
+        }
+        onEvent(event);
+        if (Object.keys(pending).length === 0) {
+            source.close();
+        }
+    });
+    return source;
+}
+
+// progressText describes an event for the users
+function progressText(event) {
+    var text = PROGRESS_LABELS[event.stage] || event.stage;
+    if (event.stage === "queued" && event.position) {
+        text += " (position " + event.position + ")";
+    } else if (event.stage === "converting" || event.stage === "packaging") {
+        text += ": " + event.percent + "%";
+    }
+    if (event.message) {
+        text += ": " + event.message;
+    }
+    return text;
+}
+
+// showProgress updates a w3.css progress bar and its label with an event
+function showProgress(bar, label, event) {
+    bar.style.width = event.percent + "%";
+    bar.className = "w3-round " + (event.stage === "failed" ? "w3-red" : event.stage === "ready" ? "w3-green" : "w3-blue");
+    label.textContent = progressText(event);
+}
@@ -0,0 +1,125 @@
+/**
+ * Minimal tus 1.0.0 client for the GoTube /tus/ endpoint.
+ * The file is sent in chunks; after a network error the upload continues from the offset
+ * known by the server, also after a page reload (the upload URL is kept in localStorage).
+ */
+var TUS_CHUNK_SIZE = 8 * 1024 * 1024;
+var TUS_MAX_RETRIES = 10;
+
+function TusFatalError(message) {
+    this.message = message;
+}
+
+function tusUpload(file, options) {
+    var storageKey = "tus::" + file.name + "::" + file.size + "::" + file.lastModified;
+    var retries = 0;
+
+    function headers(extra) {
+        var h = { "Tus-Resumable": "1.0.0" };
+        for (var k in extra) {
+            h[k] = extra[k];
+        }
+        return h;
+    }
+
+    function fatal(resp) {
+        return resp.text().then(function (text) {
+            localStorage.removeItem(storageKey);
+            throw new TusFatalError(text || resp.statusText);
+        });
+    }
+
+    // Upload-Metadata values are base64 of the UTF-8 text
+    function encode(value) {
+        return btoa(unescape(encodeURIComponent(value)));
+    }
+
+    function create() {
+        var metadata = "filename " + encode(file.name);
+        if (options.private) {
+            metadata += ",private " + btoa("1");
+        }
+        ["title", "description", "tags"].forEach(function (key) {
+            if (options[key]) {
+                metadata += "," + key + " " + encode(options[key]);
+            }
+        });
+        return fetch("/tus/", {
+            method: "POST",
+            credentials: "same-origin",
+            headers: headers({ "Upload-Length": String(file.size), "Upload-Metadata": metadata })
+        }).then(function (resp) {
+            if (resp.status !== 201) {
+                return fatal(resp);
+            }
+            var url = resp.headers.get("Location");
+            localStorage.setItem(storageKey, url);
+            return url;
+        });
+    }
+
+    // offset returns the number of bytes already stored by the server, null if the upload is unknown
+    function offset(url) {
+        return fetch(url, { method: "HEAD", credentials: "same-origin", headers: headers({}) }).then(function (resp) {
+            if (resp.status === 404 || resp.status === 410) {
+                return null;
+            }
+            if (!resp.ok) {
+                throw new Error(resp.statusText);
+            }
+            return parseInt(resp.headers.get("Upload-Offset"), 10);
+        });
+    }
+
+    function send(url, from) {
+        return fetch(url, {
+            method: "PATCH",
+            credentials: "same-origin",
+            headers: headers({ "Upload-Offset": String(from), "Content-Type": "application/offset+octet-stream" }),
+            body: file.slice(from, from + TUS_CHUNK_SIZE)
+        }).then(function (resp) {
+            if (resp.status === 409) {
+                return offset(url).then(function (o) { return send(url, o); });
+            }
+            if (resp.status !== 204) {
+                return fatal(resp);
+            }
+            retries = 0;
+            var next = parseInt(resp.headers.get("Upload-Offset"), 10);
+            options.onProgress(next, file.size);
+            if (next >= file.size) {
+                localStorage.removeItem(storageKey);
+                return resp.headers.get("GoTube-Video-Name");
+            }
+            return send(url, next);
+        });
+    }
+
+    function start() {
+        var url = localStorage.getItem(storageKey);
+        var resumed = url ? offset(url) : Promise.resolve(null);
+        return resumed.then(function (o) {
+            if (o !== null) {
+                return send(url, o);
+            }
+            return create().then(function (newUrl) {
+                url = newUrl;
+                return send(url, 0);
+            });
+        });
+    }
+
+    function attempt() {
+        return start().catch(function (err) {
+            if (err instanceof TusFatalError || retries >= TUS_MAX_RETRIES) {
+                throw err;
+            }
+            retries++;
+            var delay = Math.min(30000, 1000 * Math.pow(2, retries));
+            options.onRetry(retries, delay);
+            return new Promise(function (resolve) { setTimeout(resolve, delay); }).then(attempt);
+        });
+    }
+
+    return attempt();
+}
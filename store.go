@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The library is kept in a bbolt database (DatabasePath): the videos, the upload history of the users,
+// the conversion jobs and the view counts. The folders in ConvertPath only hold the renditions.
+var db *bolt.DB
+
+// Buckets of the database
+var (
+	bucketSchema       = []byte("schema")       // "version" -> number of migrations applied
+	bucketVideos       = []byte("videos")       // video ID -> videoMeta
+	bucketVideosByDate = []byte("videosByDate") // upload time + video ID -> video ID
+	bucketUsers        = []byte("users")        // username -> userRecord
+	bucketJobs         = []byte("jobs")         // video ID -> jobRecord of its last conversion
+	bucketViews        = []byte("views")        // video ID -> viewRecord
+)
+
+// guestsKey is the key of the guests in bucketUsers, it's not a valid username.
+const guestsKey = "\x00guests"
+
+// migrations upgrade the database, each one runs once in its own transaction.
+// New migrations are appended, the existing ones must not be changed.
+var migrations = []func(tx *bolt.Tx) error{
+	createBuckets,
+	importVideoFolders,
+	createSearchIndex,
+	createPlaylists,
+	createSearchStats,
+}
+
+// userRecord is what is stored about a user, the credentials stay in users.yaml.
+type userRecord struct {
+	Uploads []time.Time `json:"uploads,omitempty"` // uploads of the last 24 hours, for the quotas
+}
+
+// jobRecord is the last conversion of a video.
+type jobRecord struct {
+	Stage      string    `json:"stage"` // queued, ready or failed
+	Message    string    `json:"message,omitempty"`
+	QueuedAt   time.Time `json:"queuedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+}
+
+// viewRecord counts the views of a video.
+type viewRecord struct {
+	Views      int64     `json:"views"`
+	LastViewed time.Time `json:"lastViewed"`
+}
+
+// videoEntry is a video returned by listVideos.
+type videoEntry struct {
+	ID    string
+	Meta  videoMeta
+	Views int64
+}
+
+// jobEntry is a conversion shown in the queue page.
+type jobEntry struct {
+	ID    string
+	Title string
+	jobRecord
+}
+
+// openStore opens the database and applies the pending migrations.
+func openStore() error {
+	path := AppConfig.DatabasePath
+	if path == "" {
+		path = "./gotube.db"
+	}
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("the database %s is in use by another GoTube process", path)
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		var applied bool
+		err := db.Update(func(tx *bolt.Tx) error {
+			schema, err := tx.CreateBucketIfNotExists(bucketSchema)
+			if err != nil {
+				return err
+			}
+			version := 0
+			if data := schema.Get([]byte("version")); len(data) == 8 {
+				version = int(binary.BigEndian.Uint64(data))
+			}
+			if version > len(migrations) {
+				return fmt.Errorf("the database %s was created by a newer version of GoTube", path)
+			}
+			if version == len(migrations) {
+				return nil
+			}
+			if err := migrations[version](tx); err != nil {
+				return fmt.Errorf("database migration %d: %w", version+1, err)
+			}
+			applied = true
+			fmt.Println("Database migrated to version", version+1)
+			return schema.Put([]byte("version"), uint64Bytes(uint64(version+1)))
+		})
+		if err != nil || !applied {
+			return err
+		}
+	}
+}
+
+// createBuckets is the first migration.
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{bucketVideos, bucketVideosByDate, bucketUsers, bucketJobs, bucketViews} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importVideoFolders builds the records of the videos already in ConvertPath, from their meta.json if any,
+// removed once the records are saved.
+// A video without metadata is named after its folder and dated with its modification time.
+func importVideoFolders(tx *bolt.Tx) error {
+	files, err := ioutil.ReadDir(AppConfig.ConvertPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	imported := 0
+	for _, file := range files {
+		// Folders starting with a dot are used for work in progress (e.g. re-transcoding)
+		if strings.HasPrefix(file.Name(), ".") || isLive(AppConfig.ConvertPath, file.Name()) {
+			continue
+		}
+		// A video folder can be a link to a folder on another disk
+		if file.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(filepath.Join(AppConfig.ConvertPath, file.Name()))
+			if err != nil {
+				fmt.Println("Error importing video", file.Name()+":", err)
+				continue
+			}
+			file = target
+		}
+		if !file.IsDir() {
+			continue
+		}
+		var meta videoMeta
+		metaPath := filepath.Join(AppConfig.ConvertPath, file.Name(), metaFileName)
+		data, err := ioutil.ReadFile(metaPath)
+		if err == nil {
+			err = json.Unmarshal(data, &meta)
+			// /converted/ would serve it to anyone, with the uploader and the paths of the server
+			tx.OnCommit(func() {
+				if err := os.Remove(metaPath); err != nil {
+					fmt.Println("Error removing", metaPath+":", err)
+				}
+			})
+		}
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("Error importing video", file.Name()+":", err)
+		}
+		if meta.Title == "" {
+			meta.Title = file.Name()
+		}
+		if meta.UploadedAt.IsZero() {
+			meta.UploadedAt = file.ModTime()
+		}
+		meta.AudioOnly = isAudioOnly(AppConfig.ConvertPath, file.Name())
+		meta.Size = dirSize(filepath.Join(AppConfig.ConvertPath, file.Name()))
+		if err := putVideo(tx, file.Name(), meta); err != nil {
+			return err
+		}
+		imported++
+	}
+	fmt.Println("Imported", imported, "videos from", AppConfig.ConvertPath)
+	return nil
+}
+
+// recoverStore cleans up after an unclean shutdown: the conversions that were running failed
+// and the live streams are over.
+func recoverStore() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		interrupted := make(map[string]jobRecord)
+		err := jobs.ForEach(func(k, v []byte) error {
+			var job jobRecord
+			if err := json.Unmarshal(v, &job); err != nil || job.Stage != stageQueued {
+				return err
+			}
+			job.Stage, job.Message, job.FinishedAt = stageFailed, "Interrupted by a restart", time.Now()
+			interrupted[string(k)] = job
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for id, job := range interrupted {
+			if err := putJSON(jobs, id, job); err != nil {
+				return err
+			}
+		}
+		var live []string
+		err = tx.Bucket(bucketVideos).ForEach(func(k, v []byte) error {
+			var meta videoMeta
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			if meta.Live {
+				live = append(live, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range live {
+			if err := deleteVideoTx(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// findVideo returns the record of a video, false if the video is not in the library.
+func findVideo(videoName string) (videoMeta, bool, error) {
+	var meta videoMeta
+	var found bool
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketVideos).Get([]byte(videoName))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &meta)
+	})
+	return meta, found, err
+}
+
+// loadVideoMeta returns the metadata of a video. A video not in the library returns an empty videoMeta.
+func loadVideoMeta(videoName string) (videoMeta, error) {
+	meta, _, err := findVideo(videoName)
+	return meta, err
+}
+
+// saveVideoMeta adds or replaces the record of a video.
+func saveVideoMeta(videoName string, meta videoMeta) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return putVideo(tx, videoName, meta)
+	})
+}
+
+// updateVideoMeta changes the record of a video, if it is still in the library.
+func updateVideoMeta(videoName string, update func(meta *videoMeta)) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketVideos).Get([]byte(videoName))
+		if data == nil {
+			return nil
+		}
+		var meta videoMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		update(&meta)
+		return putVideo(tx, videoName, meta)
+	})
+}
+
+// deleteVideoRecord removes a video from the library, with its job and its views, and from the playlists.
+func deleteVideoRecord(videoName string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return deleteVideoTx(tx, videoName)
+	})
+}
+
+func deleteVideoTx(tx *bolt.Tx, videoName string) error {
+	key := []byte(videoName)
+	if data := tx.Bucket(bucketVideos).Get(key); data != nil {
+		var meta videoMeta
+		if err := json.Unmarshal(data, &meta); err == nil {
+			if err := tx.Bucket(bucketVideosByDate).Delete(dateKey(meta.UploadedAt, videoName)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := unindexVideo(tx, videoName); err != nil {
+		return err
+	}
+	if err := removeFromPlaylists(tx, videoName); err != nil {
+		return err
+	}
+	for _, bucket := range [][]byte{bucketVideos, bucketJobs, bucketViews} {
+		if err := tx.Bucket(bucket).Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putVideo stores a video and keeps the date index up to date.
+func putVideo(tx *bolt.Tx, videoName string, meta videoMeta) error {
+	videos, byDate := tx.Bucket(bucketVideos), tx.Bucket(bucketVideosByDate)
+	if data := videos.Get([]byte(videoName)); data != nil {
+		var old videoMeta
+		if err := json.Unmarshal(data, &old); err == nil {
+			if err := byDate.Delete(dateKey(old.UploadedAt, videoName)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := putJSON(videos, videoName, meta); err != nil {
+		return err
+	}
+	if err := indexVideo(tx, videoName, meta); err != nil {
+		return err
+	}
+	return byDate.Put(dateKey(meta.UploadedAt, videoName), []byte(videoName))
+}
+
+// dateKey is the key of a video in bucketVideosByDate, sorted by upload time.
+func dateKey(t time.Time, videoName string) []byte {
+	var nanos uint64
+	if t.After(time.Unix(0, 0)) {
+		nanos = uint64(t.UnixNano())
+	}
+	return append(uint64Bytes(nanos), videoName...)
+}
+
+// listVideos returns the videos for which visible returns true, the newest first, skipping the first offset ones
+// and returning at most limit videos. The total number of visible videos is returned too.
+func listVideos(offset, limit int, visible func(meta videoMeta) bool) ([]videoEntry, int, error) {
+	var entries []videoEntry
+	total := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		videos, views := tx.Bucket(bucketVideos), tx.Bucket(bucketViews)
+		c := tx.Bucket(bucketVideosByDate).Cursor()
+		for _, id := c.Last(); id != nil; _, id = c.Prev() {
+			data := videos.Get(id)
+			if data == nil {
+				continue
+			}
+			var meta videoMeta
+			if err := json.Unmarshal(data, &meta); err != nil {
+				fmt.Println("Error reading video", string(id)+":", err)
+				continue
+			}
+			if !visible(meta) {
+				continue
+			}
+			total++
+			if total <= offset || len(entries) >= limit {
+				continue
+			}
+			entry := videoEntry{ID: string(id), Meta: meta}
+			var view viewRecord
+			if data := views.Get(id); data != nil && json.Unmarshal(data, &view) == nil {
+				entry.Views = view.Views
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, total, err
+}
+
+// forEachVideo calls fn for every video of the library.
+func forEachVideo(fn func(videoName string, meta videoMeta)) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketVideos).ForEach(func(k, v []byte) error {
+			var meta videoMeta
+			if err := json.Unmarshal(v, &meta); err != nil {
+				fmt.Println("Error reading video", string(k)+":", err)
+				return nil
+			}
+			fn(string(k), meta)
+			return nil
+		})
+	})
+}
+
+// addUserUpload records an upload of a user ("" for the guests) and forgets the ones older than a day.
+func addUserUpload(username string, at time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		var user userRecord
+		if err := getJSON(users, userKey(username), &user); err != nil {
+			return err
+		}
+		var uploads []time.Time
+		for _, t := range user.Uploads {
+			if at.Sub(t) < 24*time.Hour {
+				uploads = append(uploads, t)
+			}
+		}
+		user.Uploads = append(uploads, at)
+		return putJSON(users, userKey(username), user)
+	})
+}
+
+// userUploads returns the uploads of a user in the last 24 hours.
+func userUploads(username string) ([]time.Time, error) {
+	var user userRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketUsers), userKey(username), &user)
+	})
+	return user.Uploads, err
+}
+
+func userKey(username string) string {
+	if username == "" {
+		return guestsKey
+	}
+	return username
+}
+
+// recordJob saves the stage of the conversion of a video: queued when it starts, then ready or failed.
+func recordJob(videoName, stage, message string) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		var job jobRecord
+		if err := getJSON(jobs, videoName, &job); err != nil {
+			return err
+		}
+		job.Stage, job.Message = stage, message
+		if stage == stageQueued {
+			job.QueuedAt, job.FinishedAt = time.Now(), time.Time{}
+		} else {
+			job.FinishedAt = time.Now()
+		}
+		return putJSON(jobs, videoName, job)
+	})
+	if err != nil {
+		fmt.Println("Error saving the job of", videoName+":", err)
+	}
+}
+
+// recentJobs returns the last conversions, the newest first.
+func recentJobs(limit int) ([]jobEntry, error) {
+	var entries []jobEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		videos := tx.Bucket(bucketVideos)
+		return tx.Bucket(bucketJobs).ForEach(func(k, v []byte) error {
+			entry := jobEntry{ID: string(k), Title: string(k)}
+			if err := json.Unmarshal(v, &entry.jobRecord); err != nil {
+				return err
+			}
+			var meta videoMeta
+			if data := videos.Get(k); data != nil && json.Unmarshal(data, &meta) == nil && meta.Title != "" {
+				entry.Title = meta.Title
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].QueuedAt.After(entries[j].QueuedAt)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, err
+}
+
+// countView adds a view to a video and returns its views.
+func countView(videoName string) int64 {
+	var view viewRecord
+	err := db.Update(func(tx *bolt.Tx) error {
+		views := tx.Bucket(bucketViews)
+		if err := getJSON(views, videoName, &view); err != nil {
+			return err
+		}
+		view.Views++
+		view.LastViewed = time.Now()
+		return putJSON(views, videoName, view)
+	})
+	if err != nil {
+		fmt.Println("Error counting the view of", videoName+":", err)
+	}
+	return view.Views
+}
+
+// getJSON decodes the value of key, leaving v unchanged if the key is missing.
+func getJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func uint64Bytes(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestStore opens a new database in a temporary folder, with ConvertPath set to convertPath.
+func openTestStore(t *testing.T, convertPath string) {
+	t.Helper()
+	saved := AppConfig
+	AppConfig.DatabasePath = filepath.Join(t.TempDir(), "gotube.db")
+	AppConfig.ConvertPath = convertPath
+	if err := openStore(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		AppConfig = saved
+	})
+}
+
+// writeVideoFolder creates the folder of a converted video with a meta.json.
+func writeVideoFolder(t *testing.T, dir, metaJSON string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "output.mpd"), []byte("<MPD/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, metaFileName), []byte(metaJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportVideoFoldersFollowsLinks(t *testing.T) {
+	convertPath := t.TempDir()
+	writeVideoFolder(t, filepath.Join(convertPath, "plainVideo01"), `{"title":"Plain"}`)
+	// The folder of a video moved to another disk
+	otherDisk := filepath.Join(t.TempDir(), "linkedVideo1")
+	writeVideoFolder(t, otherDisk, `{"title":"Linked"}`)
+	if err := os.Symlink(otherDisk, filepath.Join(convertPath, "linkedVideo1")); err != nil {
+		t.Fatal(err)
+	}
+	// Work in progress and dangling links are skipped
+	writeVideoFolder(t, filepath.Join(convertPath, retranscodeDir, "plainVideo01"), `{"title":"Work"}`)
+	if err := os.Symlink(filepath.Join(convertPath, "missing"), filepath.Join(convertPath, "danglingLink")); err != nil {
+		t.Fatal(err)
+	}
+
+	openTestStore(t, convertPath)
+	for id, title := range map[string]string{"plainVideo01": "Plain", "linkedVideo1": "Linked"} {
+		meta, found, err := findVideo(id)
+		if err != nil || !found {
+			t.Fatalf("%s not imported: %v", id, err)
+		}
+		if meta.Title != title {
+			t.Errorf("%s has title %q, want %q", id, meta.Title, title)
+		}
+		if meta.Size == 0 {
+			t.Errorf("%s has no size", id)
+		}
+	}
+	for _, dir := range []string{filepath.Join(convertPath, "plainVideo01"), otherDisk} {
+		if _, err := os.Stat(filepath.Join(dir, metaFileName)); !os.IsNotExist(err) {
+			t.Errorf("%s left in %s after the import", metaFileName, dir)
+		}
+	}
+	names, err := listVideoNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Errorf("imported %v, want only the two videos", names)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Category groups the videos having at least one of its tags. The categories are defined by the admins
+// in config.yaml, keyed by the name used in their URL (/category/<key>).
+type Category struct {
+	Name string   `yaml:"Name" json:"Name"`
+	Tags []string `yaml:"Tags" json:"Tags"`
+}
+
+// categoryLink is a category shown in the Video List.
+type categoryLink struct {
+	Key  string
+	Name string
+}
+
+// tagCount is a tag of the tag cloud.
+type tagCount struct {
+	Tag   string
+	Count int
+	Size  string // w3.css font size class
+}
+
+// tagCloudSizes are the font sizes of the tag cloud, from the least to the most used tags.
+var tagCloudSizes = []string{"w3-small", "w3-medium", "w3-large", "w3-xlarge", "w3-xxlarge"}
+
+// categoryLinks returns the categories sorted by name.
+func categoryLinks() []categoryLink {
+	var links []categoryLink
+	for key, category := range AppConfig.Categories {
+		name := category.Name
+		if name == "" {
+			name = key
+		}
+		links = append(links, categoryLink{Key: key, Name: name})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return strings.ToLower(links[i].Name) < strings.ToLower(links[j].Name)
+	})
+	return links
+}
+
+// inCategory reports whether a video has one of the tags of the category.
+func inCategory(meta videoMeta, category Category) bool {
+	for _, tag := range meta.Tags {
+		for _, categoryTag := range category.Tags {
+			if tag == strings.ToLower(strings.TrimSpace(categoryTag)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasTag reports whether a video has the given tag.
+func hasTag(meta videoMeta, tag string) bool {
+	for _, t := range meta.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// tagHandler lists the videos with a tag (/tag/<tag>).
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := strings.ToLower(strings.TrimSpace(r.PathValue("tag")))
+	if tag == "" {
+		http.Redirect(w, r, "/tags", http.StatusSeeOther)
+		return
+	}
+	renderVideoList(w, r, "Videos tagged "+tag+":", func(meta videoMeta) bool {
+		return hasTag(meta, tag)
+	})
+}
+
+// categoryHandler lists the videos of a category (/category/<key>).
+func categoryHandler(w http.ResponseWriter, r *http.Request) {
+	category, ok := AppConfig.Categories[r.PathValue("category")]
+	if !ok {
+		sendError(w, r, "Category not found")
+		return
+	}
+	name := category.Name
+	if name == "" {
+		name = r.PathValue("category")
+	}
+	renderVideoList(w, r, name+":", func(meta videoMeta) bool {
+		return inCategory(meta, category)
+	})
+}
+
+// tagCloudHandler shows the tags of the videos the request can view, sized by their use, and the categories.
+func tagCloudHandler(w http.ResponseWriter, r *http.Request) {
+	if AppConfig.VideoOnlyForUsers && !adminAuthenticated(r) && !userAuthenticated(r) {
+		http.Redirect(w, r, "/auth", http.StatusSeeOther)
+		return
+	}
+	counts := make(map[string]int)
+	err := forEachVideo(func(_ string, meta videoMeta) {
+		if !canViewVideo(r, meta) {
+			return
+		}
+		for _, tag := range meta.Tags {
+			counts[tag]++
+		}
+	})
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	maxCount := 0
+	for _, count := range counts {
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+	var tags []tagCount
+	for tag, count := range counts {
+		size := 0
+		if maxCount > 1 {
+			size = int(math.Round(math.Log(float64(count)) / math.Log(float64(maxCount)) * float64(len(tagCloudSizes)-1)))
+		}
+		tags = append(tags, tagCount{Tag: tag, Count: count, Size: tagCloudSizes[size]})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Tag < tags[j].Tag
+	})
+	renderTemplate(w, "tags", &PageTags{Tags: tags, Categories: categoryLinks()})
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads implementing the tus protocol 1.0.0 (core, creation and termination extensions),
+// see https://tus.io/protocols/resumable-upload. The partial uploads are stored in UploadPath/.tus.
+const (
+	tusVersion = "1.0.0"
+	tusDir     = ".tus"
+)
+
+var (
+	tusIDPattern = regexp.MustCompile("^[0-9a-f]{32}$")
+	tusLocks     sync.Map // upload ID -> *sync.Mutex, one request at a time per upload
+)
+
+// tusUpload is the information of a partial upload, saved next to its data. The offset is the size of the data file.
+type tusUpload struct {
+	ID          string    `json:"id"`
+	Length      int64     `json:"length"`
+	FileName    string    `json:"fileName"`
+	Uploader    string    `json:"uploader,omitempty"`
+	Role        string    `json:"role"`
+	Private     bool      `json:"private,omitempty"`
+	Title       string    `json:"title,omitempty"` // details entered by the uploader
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func tusPath(id, ext string) string {
+	return filepath.Join(AppConfig.UploadPath, tusDir, id+ext)
+}
+
+// tusHandler serves /tus/ (creation) and /tus/<id> (offset, append and termination).
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(AppConfig.MaxUploadSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	if !uploadAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/tus/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createTusUpload(w, r)
+		return
+	}
+	if !tusIDPattern.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// No lock is kept for unknown uploads, removeTusUpload deletes the lock of the known ones
+	if _, err := os.Stat(tusPath(id, ".json")); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	upload, err := loadTusUpload(id)
+	if os.IsNotExist(err) {
+		// Removed while waiting for the lock
+		tusLocks.Delete(id)
+	}
+	if err != nil || upload.Uploader != requestUsername(r) {
+		http.NotFound(w, r)
+		return
+	}
+	offset, err := tusOffset(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		patchTusUpload(w, r, upload, offset)
+	case http.MethodDelete:
+		removeTusUpload(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createTusUpload checks the size, name and upload rate before accepting any data.
+func createTusUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > AppConfig.MaxUploadSize {
+		http.Error(w, "The file is too big. Max size allowed: "+strconv.FormatInt(AppConfig.MaxUploadSize, 10), http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err := checkVideoTitle(videoTitle(metadata["filename"])); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var details videoMeta
+	if err := setVideoDetails(&details, metadata["title"], metadata["description"], metadata["tags"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkUploadLimits(requestUsername(r), requestRole(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err := checkStorageQuota(requestUsername(r), requestRole(r), length); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	upload := tusUpload{
+		ID:          hex.EncodeToString(random),
+		Length:      length,
+		FileName:    metadata["filename"],
+		Uploader:    requestUsername(r),
+		Role:        requestRole(r),
+		Title:       details.Title,
+		Description: details.Description,
+		Tags:        details.Tags,
+		CreatedAt:   time.Now(),
+	}
+	_, upload.Private = metadata["private"]
+	upload.Private = upload.Private && AppConfig.AllowPrivateVideos && upload.Uploader != ""
+	if err := saveTusUpload(upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	countUpload(upload.Uploader)
+
+	w.Header().Set("Location", "/tus/"+upload.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patchTusUpload appends the request body to the upload. Data received before a disconnection is kept,
+// the client resumes from the offset returned by HEAD.
+func patchTusUpload(w http.ResponseWriter, r *http.Request, upload tusUpload, offset int64) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if requested, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || requested != offset {
+		http.Error(w, "Upload-Offset doesn't match", http.StatusConflict)
+		return
+	}
+
+	out, err := os.OpenFile(tusPath(upload.ID, ".bin"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(out, io.LimitReader(r.Body, upload.Length-offset))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	offset += n
+	if err != nil {
+		fmt.Println("Resumable upload", upload.ID, "interrupted at", offset, "bytes:", err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	videoName, err := finishTusUpload(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("GoTube-Video-Name", videoName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload moves a completed upload to UploadPath and queues its conversion.
+func finishTusUpload(upload tusUpload) (string, error) {
+	defer removeTusUpload(upload.ID)
+	filePath, err := newUploadPath(upload.FileName)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(tusPath(upload.ID, ".bin"), filePath); err != nil {
+		return "", err
+	}
+	meta := newVideoMeta(upload.Uploader, upload.FileName)
+	meta.Private = upload.Private
+	if upload.Title != "" {
+		meta.Title = upload.Title
+	}
+	meta.Description, meta.Tags = upload.Description, upload.Tags
+	if err := ingestFile(filePath, upload.Role, meta); err != nil {
+		return "", err
+	}
+	return videoIDFromFile(filePath), nil
+}
+
+// parseTusMetadata decodes the Upload-Metadata header: comma separated "key base64value" pairs.
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
+
+func loadTusUpload(id string) (tusUpload, error) {
+	var upload tusUpload
+	data, err := ioutil.ReadFile(tusPath(id, ".json"))
+	if err != nil {
+		return upload, err
+	}
+	err = json.Unmarshal(data, &upload)
+	return upload, err
+}
+
+func saveTusUpload(upload tusUpload) error {
+	if err := os.MkdirAll(filepath.Join(AppConfig.UploadPath, tusDir), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(tusPath(upload.ID, ".bin"), nil, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tusPath(upload.ID, ".json"), data, 0644)
+}
+
+func tusOffset(id string) (int64, error) {
+	fi, err := os.Stat(tusPath(id, ".bin"))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func removeTusUpload(id string) {
+	for _, ext := range []string{".bin", ".json"} {
+		if err := os.Remove(tusPath(id, ext)); err != nil && !os.IsNotExist(err) {
+			fmt.Println("error removing resumable upload:", err)
+		}
+	}
+	tusLocks.Delete(id)
+}
+
+// deleteStaleTusUploads removes every hour the partial uploads not resumed within TusExpiration.
+func deleteStaleTusUploads() {
+	expiration, err := time.ParseDuration(AppConfig.TusExpiration)
+	if err != nil {
+		fmt.Println("Error parsing TusExpiration from config.yaml. Using default value (24h)", err)
+		expiration = 24 * time.Hour
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		entries, err := ioutil.ReadDir(filepath.Join(AppConfig.UploadPath, tusDir))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		for _, entry := range entries {
+			if filepath.Ext(entry.Name()) == ".bin" && time.Since(entry.ModTime()) > expiration {
+				fmt.Println("Removing stale resumable upload", entry.Name())
+				removeTusUpload(strings.TrimSuffix(entry.Name(), ".bin"))
+			}
+		}
+		select {
+		case <-appCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
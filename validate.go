@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UploadPolicy limits the media accepted for upload. Zero values and empty lists mean no limit.
+type UploadPolicy struct {
+	MaxDuration       string   `yaml:"MaxDuration" json:"MaxDuration"` // e.g. "2h"
+	MaxWidth          int      `yaml:"MaxWidth" json:"MaxWidth"`
+	MaxHeight         int      `yaml:"MaxHeight" json:"MaxHeight"`
+	MaxFrameRate      float64  `yaml:"MaxFrameRate" json:"MaxFrameRate"`
+	AllowedContainers []string `yaml:"AllowedContainers" json:"AllowedContainers"` // ffprobe format names, e.g. mp4, matroska, mp3
+	AllowedCodecs     []string `yaml:"AllowedCodecs" json:"AllowedCodecs"`         // ffprobe codec names, e.g. h264, hevc, aac
+}
+
+// requestRole returns the role of the user sending the request, "guest" if not authenticated.
+func requestRole(r *http.Request) string {
+	if user, ok := authenticatedUser(r); ok {
+		return user.Role
+	}
+	return "guest"
+}
+
+// validateUpload probes an uploaded file and checks it against the upload policy of the given role
+// and against the minutes quota of the uploader.
+func validateUpload(filePath, username, role string) error {
+	info, err := probeMedia(filePath)
+	if err != nil || info.Decodable == 0 || (!info.HasVideo && !info.HasAudio) {
+		return errors.New("the file is not a video or audio file, or it has no decodable streams")
+	}
+	if err := checkMinutesQuota(username, role, info.Duration); err != nil {
+		return err
+	}
+	policy, ok := AppConfig.UploadPolicies[role]
+	if !ok {
+		return nil
+	}
+	return policy.check(info)
+}
+
+// check returns an error describing the first limit of the policy exceeded by the media.
+func (p UploadPolicy) check(info mediaInfo) error {
+	if p.MaxDuration != "" {
+		maxDuration, err := time.ParseDuration(p.MaxDuration)
+		if err != nil {
+			fmt.Println("Error parsing MaxDuration of UploadPolicies from config.yaml:", err)
+		} else if info.Duration > maxDuration.Seconds() {
+			return fmt.Errorf("the duration is longer than %s", maxDuration)
+		}
+	}
+	if p.MaxWidth > 0 && info.Width > p.MaxWidth {
+		return fmt.Errorf("the width %d is larger than %d pixels", info.Width, p.MaxWidth)
+	}
+	if p.MaxHeight > 0 && info.Height > p.MaxHeight {
+		return fmt.Errorf("the height %d is larger than %d pixels", info.Height, p.MaxHeight)
+	}
+	if p.MaxFrameRate > 0 && info.FrameRate > p.MaxFrameRate {
+		return fmt.Errorf("the frame rate %.2f is higher than %.2f fps", info.FrameRate, p.MaxFrameRate)
+	}
+	if len(p.AllowedContainers) > 0 && !containsAny(p.AllowedContainers, info.Formats) {
+		return fmt.Errorf("the container %s is not allowed, allowed containers: %s", strings.Join(info.Formats, ","), strings.Join(p.AllowedContainers, ", "))
+	}
+	if len(p.AllowedCodecs) > 0 {
+		for _, codec := range info.Codecs {
+			if !containsAny(p.AllowedCodecs, []string{codec}) {
+				return fmt.Errorf("the codec %s is not allowed, allowed codecs: %s", codec, strings.Join(p.AllowedCodecs, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// containsAny reports whether at least one of values is in list (case insensitive).
+func containsAny(list, values []string) bool {
+	for _, v := range values {
+		for _, l := range list {
+			if strings.EqualFold(strings.TrimSpace(l), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
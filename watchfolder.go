@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	watchProcessedDir = "processed"
+	watchFailedDir    = "failed"
+)
+
+// watchSidecar is the optional <file>.json (or <file name without extension>.json) next to a video
+// in WatchFolder, every field is optional.
+type watchSidecar struct {
+	Title      string    `json:"title"`
+	Uploader   string    `json:"uploader"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchFolder scans WatchFolder every WatchInterval seconds and imports the files whose size and
+// modification time didn't change since the previous scan. Polling works on network shares, where
+// inotify events are not delivered.
+func watchFolder() {
+	for _, dir := range []string{watchProcessedDir, watchFailedDir} {
+		if err := os.MkdirAll(filepath.Join(AppConfig.WatchFolder, dir), 0755); err != nil {
+			fmt.Println("Error creating watch folder:", err)
+			return
+		}
+	}
+	interval := time.Duration(AppConfig.WatchInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	fmt.Println("Watching", AppConfig.WatchFolder, "for new videos")
+
+	seen := make(map[string]watchedFile)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		seen = scanWatchFolder(seen)
+		select {
+		case <-appCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scanWatchFolder imports the files that are unchanged since the previous scan and returns the state of the others.
+func scanWatchFolder(previous map[string]watchedFile) map[string]watchedFile {
+	current := make(map[string]watchedFile)
+	entries, err := ioutil.ReadDir(AppConfig.WatchFolder)
+	if err != nil {
+		fmt.Println("Error reading watch folder:", err)
+		return current
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.EqualFold(filepath.Ext(name), ".json") {
+			continue
+		}
+		state := watchedFile{size: entry.Size(), modTime: entry.ModTime()}
+		if prev, ok := previous[name]; !ok || prev != state || state.size == 0 {
+			current[name] = state
+			continue
+		}
+		if appCtx.Err() != nil {
+			return current
+		}
+		importWatchedFile(name)
+	}
+	return current
+}
+
+// importWatchedFile copies a file of WatchFolder to UploadPath and queues its conversion, then moves the
+// file and its sidecar to the processed folder, or to the failed one with a .error.txt telling why.
+func importWatchedFile(name string) {
+	srcPath := filepath.Join(AppConfig.WatchFolder, name)
+	sidecarPath, sidecar, err := loadWatchSidecar(srcPath)
+	if err == nil {
+		err = ingestWatchedFile(srcPath, sidecar)
+	}
+
+	destDir := watchProcessedDir
+	if err != nil {
+		destDir = watchFailedDir
+		fmt.Println("Import of", srcPath, "failed:", err)
+		if err := ioutil.WriteFile(filepath.Join(AppConfig.WatchFolder, watchFailedDir, name+".error.txt"), []byte(err.Error()+"\n"), 0644); err != nil {
+			fmt.Println(err)
+		}
+	}
+	for _, path := range []string{srcPath, sidecarPath} {
+		if path == "" {
+			continue
+		}
+		if err := os.Rename(path, filepath.Join(AppConfig.WatchFolder, destDir, filepath.Base(path))); err != nil {
+			fmt.Println("Error moving imported file:", err)
+		}
+	}
+}
+
+// ingestWatchedFile copies srcPath to UploadPath with a new video ID and queues its conversion.
+func ingestWatchedFile(srcPath string, sidecar watchSidecar) error {
+	filePath, err := newUploadPath(filepath.Base(srcPath))
+	if err != nil {
+		return err
+	}
+	if err := copyFile(srcPath, filePath, false); err != nil {
+		return err
+	}
+
+	meta := newVideoMeta(AppConfig.WatchUploader, filepath.Base(srcPath))
+	meta.Title = sidecar.Title
+	if meta.Title == "" {
+		meta.Title = videoTitle(filepath.Base(srcPath))
+	}
+	if sidecar.Uploader != "" {
+		meta.Uploader = sidecar.Uploader
+	}
+	if !sidecar.UploadedAt.IsZero() {
+		meta.UploadedAt = sidecar.UploadedAt
+	}
+	role := "admin"
+	if meta.Uploader != "" {
+		role = "guest"
+		for _, user := range users {
+			if user.Username == meta.Uploader {
+				role = user.Role
+			}
+		}
+	}
+	if err := ingestFile(filePath, role, meta); err != nil {
+		return err
+	}
+	fmt.Println("Imported from watch folder:", srcPath, "as", videoIDFromFile(filePath))
+	return nil
+}
+
+// loadWatchSidecar reads the sidecar of a watched file, returning its path ("" if there is none).
+func loadWatchSidecar(srcPath string) (string, watchSidecar, error) {
+	var sidecar watchSidecar
+	for _, path := range []string{srcPath + ".json", strings.TrimSuffix(srcPath, filepath.Ext(srcPath)) + ".json"} {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return path, sidecar, err
+		}
+		if err := json.Unmarshal(data, &sidecar); err != nil {
+			return path, sidecar, fmt.Errorf("invalid sidecar %s: %w", filepath.Base(path), err)
+		}
+		return path, sidecar, nil
+	}
+	return "", sidecar, nil
+}